@@ -0,0 +1,90 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+const (
+	// BaseAnnotation is the target annotation holding its spec without any merged route
+	BaseAnnotation = "istiomerger.monime.sl/base"
+	// RenderedAnnotation is the target annotation holding the hash of the last rendered spec
+	RenderedAnnotation = "istiomerger.monime.sl/rendered"
+)
+
+// ReadBase returns the base spec stored on the target. The base is nil when none was
+// stored or when the target was modified since it was last rendered, in which case
+// the current spec of the target is the one to rebase on.
+func ReadBase(target *alpha3.VirtualService) (*v1alpha3.VirtualService, error) {
+	data, ok := target.Annotations[BaseAnnotation]
+	if !ok || target.Annotations[RenderedAnnotation] != SpecHash(&target.Spec) {
+		return nil, nil
+	}
+	base := &v1alpha3.VirtualService{}
+	if err := base.UnmarshalJSON([]byte(data)); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on VirtualService %s/%s: %w",
+			BaseAnnotation, target.Namespace, target.Name, err)
+	}
+	return base, nil
+}
+
+// WriteBase stores the base spec on the target along with the hash of its current spec
+func WriteBase(target *alpha3.VirtualService, base *v1alpha3.VirtualService) error {
+	data, err := base.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if target.Annotations == nil {
+		target.Annotations = map[string]string{}
+	}
+	target.Annotations[BaseAnnotation] = string(data)
+	target.Annotations[RenderedAnnotation] = SpecHash(&target.Spec)
+	return nil
+}
+
+// SpecHash returns a stable hash of the VirtualService spec
+func SpecHash(spec *v1alpha3.VirtualService) string {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(spec)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Unmanaged returns a copy of the spec without the routes and list field values contributed by a merge
+func (in OwnershipLedger) Unmanaged(spec *v1alpha3.VirtualService) *v1alpha3.VirtualService {
+	base := spec.DeepCopy()
+	keys := map[string]bool{}
+	for key := range in {
+		keys[key] = true
+	}
+	base.Http = removeHttpRoutes(base.Http, keys)
+	base.Tcp = removeTcpRoutes(base.Tcp, keys)
+	base.Tls = removeTlsRoutes(base.Tls, keys)
+	base.Hosts = removeValues(base.Hosts, in, MergeFieldHosts)
+	base.Gateways = removeValues(base.Gateways, in, MergeFieldGateways)
+	base.ExportTo = removeValues(base.ExportTo, in, MergeFieldExportTo)
+	return base
+}
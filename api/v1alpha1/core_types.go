@@ -16,10 +16,25 @@
 
 package v1alpha1
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
 
 var (
-	errEmptyTargetName = errors.New("empty target name")
+	errEmptyTargetName          = errors.New("empty target name")
+	errExclusiveTargets         = errors.New("the target name, selector and host are exclusive")
+	errGatewayWithoutHost       = errors.New("the target gateway requires a host")
+	errCreateWithoutName        = errors.New("the target can only be created when designated by name")
+	errCreateWithoutTemplate    = errors.New("the target template requires at least one host to create the target")
+	errNamespaceSelector        = errors.New("the target namespace selector requires a selector")
+	errNamespaceAndSelector     = errors.New("the target namespace and namespace selector are exclusive")
+	errSelectorWithoutSelection = errors.New("the target selector must select by labels or expressions")
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -30,15 +45,143 @@ type Target struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// +kubebuilder:validation:Required
+	// Name is the name of the target VirtualService, exclusive with Selector and Host
+	// +optional
 	Name string `json:"name,omitempty"`
 
 	Namespace string `json:"namespace,omitempty"`
+
+	// Selector selects the target VirtualServices by their labels, in Namespace or in
+	// the namespaces selected by NamespaceSelector. Exclusive with Name.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// NamespaceSelector selects the namespaces of the VirtualServices selected by Selector
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Host resolves the target to the VirtualService whose hosts contain it, in Namespace
+	// or in any namespace when unset. Exclusive with Name and Selector.
+	// +optional
+	Host string `json:"host,omitempty"`
+	// Gateway restricts the VirtualServices resolved by Host to the ones bound to the gateway
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// CreateIfMissing creates the target VirtualService from Template when it does not exist.
+	// The created VirtualService is deleted when the last merge targeting it is removed.
+	// +optional
+	CreateIfMissing bool `json:"createIfMissing,omitempty"`
+	// Template is the spec of the target VirtualService created when missing
+	// +optional
+	Template *TargetTemplate `json:"template,omitempty"`
 }
 
 func (in *Target) Validate() error {
-	if in.Name == "" {
+	targets := 0
+	for _, set := range []bool{in.Name != "", in.Selector != nil, in.Host != ""} {
+		if set {
+			targets++
+		}
+	}
+	switch {
+	case targets == 0:
 		return errEmptyTargetName
+	case targets > 1:
+		return errExclusiveTargets
+	case in.Gateway != "" && in.Host == "":
+		return errGatewayWithoutHost
+	case in.CreateIfMissing && in.Name == "":
+		return errCreateWithoutName
+	case in.CreateIfMissing && (in.Template == nil || len(in.Template.Hosts) == 0):
+		return errCreateWithoutTemplate
+	case in.Selector != nil && len(in.Selector.MatchLabels) == 0 && len(in.Selector.MatchExpressions) == 0:
+		// an empty selector would select every VirtualService
+		return errSelectorWithoutSelection
+	case in.NamespaceSelector != nil && in.Selector == nil:
+		return errNamespaceSelector
+	case in.NamespaceSelector != nil && in.Namespace != "":
+		return errNamespaceAndSelector
 	}
 	return nil
 }
+
+// IsSelector reports whether the target selects its VirtualServices by labels
+func (in *Target) IsSelector() bool {
+	return in.Selector != nil
+}
+
+// Selectors returns the label selectors of the VirtualServices and of their namespaces,
+// the latter being nil when the VirtualServices are selected in a single namespace.
+func (in *Target) Selectors() (labels.Selector, labels.Selector, error) {
+	selector, err := metav1.LabelSelectorAsSelector(in.Selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in.NamespaceSelector == nil {
+		return selector, nil, nil
+	}
+	namespaceSelector, err := metav1.LabelSelectorAsSelector(in.NamespaceSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	return selector, namespaceSelector, nil
+}
+
+// Matches reports whether the target matches the VirtualService. The namespace selector
+// is not evaluated, a VirtualService of any namespace matches the target when it is set.
+func (in *Target) Matches(defaultNamespace string, vs *v1alpha3.VirtualService) bool {
+	if in.Host != "" {
+		return (in.Namespace == "" || in.Namespace == vs.Namespace) && containsValue(vs.Spec.Hosts, in.Host) &&
+			(in.Gateway == "" || hasGateway(vs, in.Gateway))
+	}
+	if !in.IsSelector() {
+		return in.Reference(defaultNamespace) == TargetReference{Name: vs.GetName(), Namespace: vs.GetNamespace()}
+	}
+	selector, _, err := in.Selectors()
+	if err != nil {
+		return false
+	}
+	if in.NamespaceSelector == nil && in.Reference(defaultNamespace).Namespace != vs.GetNamespace() {
+		return false
+	}
+	return selector.Matches(labels.Set(vs.GetLabels()))
+}
+
+// String describes the target resolved against the namespace of the merge
+func (in *Target) String(defaultNamespace string) string {
+	switch {
+	case in.IsSelector():
+		return "VirtualServices selected by " + metav1.FormatLabelSelector(in.Selector)
+	case in.Host != "" && in.Gateway != "":
+		return fmt.Sprintf("VirtualService with host %s on gateway %s", in.Host, in.Gateway)
+	case in.Host != "":
+		return "VirtualService with host " + in.Host
+	}
+	return in.Reference(defaultNamespace).String()
+}
+
+// hasGateway reports whether the VirtualService is bound to the gateway, the
+// gateways without a namespace being in the namespace of the VirtualService
+func hasGateway(vs *v1alpha3.VirtualService, gateway string) bool {
+	qualify := func(gateway string) string {
+		if gateway == "mesh" || strings.Contains(gateway, "/") {
+			return gateway
+		}
+		return vs.Namespace + "/" + gateway
+	}
+	for _, g := range vs.Spec.Gateways {
+		if qualify(g) == qualify(gateway) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reference resolves the target against the namespace of the merge
+func (in *Target) Reference(defaultNamespace string) TargetReference {
+	namespace := in.Namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	return TargetReference{Name: in.Name, Namespace: namespace}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"istio.io/api/networking/v1alpha3"
+)
+
+// TargetDiff is the change of the routes and list fields of a VirtualService made by merging.
+// Http routes are identified by name, tcp and tls routes by their match attributes, and list
+// field values by their field, e.g. "http/reviews-0", "tcp/5432|||||" or "hosts/a.example.com".
+type TargetDiff struct {
+	Added     []string `json:"added,omitempty"`
+	Replaced  []string `json:"replaced,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+	Reordered []string `json:"reordered,omitempty"`
+}
+
+// DiffTargets returns the change from the before spec to the after spec
+func DiffTargets(before, after *v1alpha3.VirtualService) TargetDiff {
+	diff := TargetDiff{}
+	beforeKeys, beforeRoutes := specEntries(before)
+	afterKeys, afterRoutes := specEntries(after)
+	for _, key := range afterKeys {
+		if previous, ok := beforeRoutes[key]; !ok {
+			diff.Added = append(diff.Added, key)
+		} else if !proto.Equal(previous, afterRoutes[key]) {
+			diff.Replaced = append(diff.Replaced, key)
+		}
+	}
+	for _, key := range beforeKeys {
+		if _, ok := afterRoutes[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	// the http routes kept by both specs which moved relative to the others
+	beforeOrder, afterOrder := keptRoutes(beforeKeys, afterRoutes), keptRoutes(afterKeys, beforeRoutes)
+	unmoved := longestCommonSequence(beforeOrder, afterOrder)
+	for _, key := range afterOrder {
+		if !unmoved[key] {
+			diff.Reordered = append(diff.Reordered, key)
+		}
+	}
+	return diff
+}
+
+// Empty reports whether nothing changed
+func (in TargetDiff) Empty() bool {
+	return len(in.Added) == 0 && len(in.Replaced) == 0 && len(in.Removed) == 0 && len(in.Reordered) == 0
+}
+
+func (in TargetDiff) String() string {
+	if in.Empty() {
+		return "no change"
+	}
+	parts := make([]string, 0, 4)
+	for _, part := range []struct {
+		name string
+		keys []string
+	}{{"added", in.Added}, {"replaced", in.Replaced}, {"removed", in.Removed}, {"reordered", in.Reordered}} {
+		if len(part.keys) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", part.name, strings.Join(part.keys, ", ")))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// specEntries returns the keys of the routes and list field values of the spec in order, with their content
+func specEntries(spec *v1alpha3.VirtualService) ([]string, map[string]proto.Message) {
+	keys := make([]string, 0)
+	entries := map[string]proto.Message{}
+	add := func(key string, entry proto.Message) {
+		if _, ok := entries[key]; !ok {
+			keys = append(keys, key)
+		}
+		entries[key] = entry
+	}
+	unnamed := 0
+	for _, route := range spec.Http {
+		name := route.Name
+		if name == "" {
+			// routes without a name are told apart by their position among themselves
+			name = fmt.Sprintf("unnamed[%d]", unnamed)
+			unnamed++
+		}
+		add(httpLedgerKey(name), route)
+	}
+	for _, route := range spec.Tcp {
+		add(tcpLedgerKey(tcpMatchKey(route.Match)), route)
+	}
+	for _, route := range spec.Tls {
+		add(tlsLedgerKey(tlsMatchKey(route.Match)), route)
+	}
+	for _, field := range []struct {
+		field  MergeField
+		values []string
+	}{{MergeFieldHosts, spec.Hosts}, {MergeFieldGateways, spec.Gateways}, {MergeFieldExportTo, spec.ExportTo}} {
+		for _, value := range field.values {
+			add(string(field.field)+"/"+value, nil)
+		}
+	}
+	return keys, entries
+}
+
+func keptRoutes(keys []string, other map[string]proto.Message) []string {
+	kept := make([]string, 0)
+	for _, key := range keys {
+		if _, ok := other[key]; ok && strings.HasPrefix(key, httpKind) {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
+
+// longestCommonSequence returns the keys of the longest subsequence common to both
+// sequences, the keys outside of it are the ones which moved.
+func longestCommonSequence(s1, s2 []string) map[string]bool {
+	lengths := make([][]int, len(s1)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(s2)+1)
+	}
+	for i := len(s1) - 1; i >= 0; i-- {
+		for j := len(s2) - 1; j >= 0; j-- {
+			if s1[i] == s2[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	common := map[string]bool{}
+	for i, j := 0, 0; i < len(s1) && j < len(s2); {
+		switch {
+		case s1[i] == s2[j]:
+			common[s1[i]] = true
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return common
+}
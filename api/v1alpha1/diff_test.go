@@ -0,0 +1,151 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+func TestDiffTargets(t *testing.T) {
+	routes := func(routes ...*v1alpha3.HTTPRoute) *v1alpha3.VirtualService {
+		return &v1alpha3.VirtualService{Http: routes}
+	}
+	tests := []struct {
+		name          string
+		before, after *v1alpha3.VirtualService
+		want          TargetDiff
+	}{
+		{
+			name:   "no change",
+			before: routes(httpRoute("a", "a"), httpRoute("b", "b")),
+			after:  routes(httpRoute("a", "a"), httpRoute("b", "b")),
+		},
+		{
+			name:   "added route",
+			before: routes(httpRoute("a", "a")),
+			after:  routes(httpRoute("b", "b"), httpRoute("a", "a")),
+			want:   TargetDiff{Added: []string{"http/b"}},
+		},
+		{
+			name:   "replaced route",
+			before: routes(httpRoute("a", "a"), httpRoute("b", "b")),
+			after:  routes(httpRoute("a", "a2"), httpRoute("b", "b")),
+			want:   TargetDiff{Replaced: []string{"http/a"}},
+		},
+		{
+			name:   "removed route",
+			before: routes(httpRoute("a", "a"), httpRoute("b", "b")),
+			after:  routes(httpRoute("b", "b")),
+			want:   TargetDiff{Removed: []string{"http/a"}},
+		},
+		{
+			name:   "moved route",
+			before: routes(httpRoute("a", "a"), httpRoute("b", "b"), httpRoute("c", "c")),
+			after:  routes(httpRoute("c", "c"), httpRoute("a", "a"), httpRoute("b", "b")),
+			want:   TargetDiff{Reordered: []string{"http/c"}},
+		},
+		{
+			name:   "insertions and removals do not reorder",
+			before: routes(httpRoute("a", "a"), httpRoute("b", "b"), httpRoute("c", "c")),
+			after:  routes(httpRoute("x", "x"), httpRoute("a", "a"), httpRoute("c", "c")),
+			want:   TargetDiff{Added: []string{"http/x"}, Removed: []string{"http/b"}},
+		},
+		{
+			name:   "moved and replaced route",
+			before: routes(httpRoute("a", "a"), httpRoute("b", "b"), httpRoute("c", "c"), httpRoute("d", "d")),
+			after:  routes(httpRoute("a", "a"), httpRoute("c", "c"), httpRoute("x", "x"), httpRoute("d", "d"), httpRoute("b", "b2")),
+			want:   TargetDiff{Added: []string{"http/x"}, Replaced: []string{"http/b"}, Reordered: []string{"http/b"}},
+		},
+		{
+			name:   "unnamed routes by position",
+			before: routes(httpRoute("", "u1"), httpRoute("a", "a")),
+			after:  routes(httpRoute("", "u0"), httpRoute("a", "a"), httpRoute("", "u1")),
+			want:   TargetDiff{Added: []string{"http/unnamed[1]"}, Replaced: []string{"http/unnamed[0]"}},
+		},
+		{
+			name:   "unnamed route moved",
+			before: routes(httpRoute("a", "a"), httpRoute("b", "b"), httpRoute("", "u")),
+			after:  routes(httpRoute("", "u"), httpRoute("a", "a"), httpRoute("b", "b")),
+			want:   TargetDiff{Reordered: []string{"http/unnamed[0]"}},
+		},
+		{
+			name: "tcp routes and list fields",
+			before: &v1alpha3.VirtualService{
+				Hosts: []string{"a.example.com"},
+				Tcp:   []*v1alpha3.TCPRoute{{Match: []*v1alpha3.L4MatchAttributes{{Port: 5432}}}},
+			},
+			after: &v1alpha3.VirtualService{
+				Hosts: []string{"b.example.com"},
+				Tcp:   []*v1alpha3.TCPRoute{{Match: []*v1alpha3.L4MatchAttributes{{Port: 5432}}}, {Match: []*v1alpha3.L4MatchAttributes{{Port: 5433}}}},
+			},
+			want: TargetDiff{
+				Added:   []string{tcpLedgerKey(tcpMatchKey([]*v1alpha3.L4MatchAttributes{{Port: 5433}})), "hosts/b.example.com"},
+				Removed: []string{"hosts/a.example.com"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := DiffTargets(tt.before, tt.after)
+			assertStrings(t, diff.Added, tt.want.Added...)
+			assertStrings(t, diff.Replaced, tt.want.Replaced...)
+			assertStrings(t, diff.Removed, tt.want.Removed...)
+			assertStrings(t, diff.Reordered, tt.want.Reordered...)
+			if diff.Empty() != tt.want.Empty() {
+				t.Errorf("Empty() = %v, want %v", diff.Empty(), tt.want.Empty())
+			}
+		})
+	}
+}
+
+func TestTargetDiffString(t *testing.T) {
+	if got := (TargetDiff{}).String(); got != "no change" {
+		t.Errorf("String() = %q, want no change", got)
+	}
+	diff := TargetDiff{Added: []string{"http/a", "http/b"}, Reordered: []string{"http/c"}}
+	if got, want := diff.String(), "added: http/a, http/b; reordered: http/c"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestLongestCommonSequence(t *testing.T) {
+	tests := []struct {
+		s1, s2 []string
+		want   []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c"}, []string{"c", "a", "b"}, []string{"a", "b"}},
+		{[]string{"a", "b", "c", "d"}, []string{"b", "c", "d", "a"}, []string{"b", "c", "d"}},
+		{[]string{"a", "b", "c", "d"}, []string{"a", "d", "b", "c"}, []string{"a", "b", "c"}},
+		{[]string{"a", "b"}, []string{"c"}, nil},
+	}
+	for _, tt := range tests {
+		common := longestCommonSequence(tt.s1, tt.s2)
+		if len(common) != len(tt.want) {
+			t.Errorf("longestCommonSequence(%v, %v) = %v, want %v", tt.s1, tt.s2, common, tt.want)
+			continue
+		}
+		for _, key := range tt.want {
+			if !common[key] {
+				t.Errorf("longestCommonSequence(%v, %v) = %v, want %v", tt.s1, tt.s2, common, tt.want)
+			}
+		}
+	}
+}
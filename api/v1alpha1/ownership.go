@@ -0,0 +1,214 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// OwnershipAnnotation is the target annotation holding the ownership ledger of the merged routes
+	OwnershipAnnotation = "istiomerger.monime.sl/owners"
+
+	httpKind = "http/"
+	tcpKind  = "tcp/"
+	tlsKind  = "tls/"
+)
+
+// RouteOwner identifies the VirtualServiceMerge a route of the target came from
+type RouteOwner struct {
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	UID        types.UID `json:"uid"`
+	Generation int64     `json:"generation"`
+	// Priority is the explicit priority of an http route, see VirtualServiceMergeSpec
+	Priority *int32 `json:"priority,omitempty"`
+}
+
+func (in RouteOwner) String() string {
+	return in.Namespace + "/" + in.Name
+}
+
+// OwnershipLedger maps the keys of the routes merged into a target to their owners.
+// Routes of the target without an entry are foreign and never mutated by a merge.
+type OwnershipLedger map[string]RouteOwner
+
+// ReadLedger reads the ownership ledger stored on the target
+func ReadLedger(target *alpha3.VirtualService) (OwnershipLedger, error) {
+	ledger := OwnershipLedger{}
+	data, ok := target.Annotations[OwnershipAnnotation]
+	if !ok || data == "" {
+		return ledger, nil
+	}
+	if err := json.Unmarshal([]byte(data), &ledger); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on VirtualService %s/%s: %w",
+			OwnershipAnnotation, target.Namespace, target.Name, err)
+	}
+	return ledger, nil
+}
+
+// Write stores the ledger on the target, removing the annotation once empty
+func (in OwnershipLedger) Write(target *alpha3.VirtualService) error {
+	if len(in) == 0 {
+		delete(target.Annotations, OwnershipAnnotation)
+		return nil
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	if target.Annotations == nil {
+		target.Annotations = map[string]string{}
+	}
+	target.Annotations[OwnershipAnnotation] = string(data)
+	return nil
+}
+
+func (in OwnershipLedger) claim(key string, merge *VirtualServiceMerge) {
+	in.claimRoute(key, merge, nil)
+}
+
+func (in OwnershipLedger) claimRoute(key string, merge *VirtualServiceMerge, priority *int32) {
+	in[key] = RouteOwner{
+		Namespace:  merge.Namespace,
+		Name:       merge.Name,
+		UID:        merge.UID,
+		Generation: merge.Generation,
+		Priority:   priority,
+	}
+}
+
+// Adopt records the merge as the owner of the routes it wrote to the target before the
+// ledger existed, telling them apart from the routes not managed by any merge
+func (in OwnershipLedger) Adopt(merge *VirtualServiceMerge) {
+	for _, key := range merge.trackedKeys() {
+		if _, ok := in[key]; !ok {
+			in.claim(key, merge)
+		}
+	}
+}
+
+func (in OwnershipLedger) release(keys map[string]bool) {
+	for key := range keys {
+		delete(in, key)
+	}
+}
+
+// describe tells who a route key belongs to, for reporting protected routes
+func (in OwnershipLedger) describe(key string) string {
+	if owner, ok := in[key]; ok {
+		return fmt.Sprintf("%s (owned by %s)", key, owner)
+	}
+	return fmt.Sprintf("%s (not managed by any merge)", key)
+}
+
+func httpLedgerKey(name string) string {
+	return httpKind + name
+}
+
+func tcpLedgerKey(match string) string {
+	return tcpKind + match
+}
+
+func tlsLedgerKey(match string) string {
+	return tlsKind + match
+}
+
+// owns reports whether the merge may mutate or remove the target route with the key
+func (in *VirtualServiceMerge) owns(ledger OwnershipLedger, key string) bool {
+	if owner, ok := ledger[key]; ok {
+		return owner.UID == in.UID
+	}
+	// routes recorded in the status or written by a legacy merge were merged before the ledger existed
+	for _, tracked := range in.trackedKeys() {
+		if tracked == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedKeys returns the keys of the given kind the merge owns on the target
+func (in *VirtualServiceMerge) ownedKeys(ledger OwnershipLedger, kind string) map[string]bool {
+	keys := map[string]bool{}
+	for key, owner := range ledger {
+		if strings.HasPrefix(key, kind) && owner.UID == in.UID {
+			keys[key] = true
+		}
+	}
+	for _, key := range in.trackedKeys() {
+		if _, ok := ledger[key]; !ok && strings.HasPrefix(key, kind) {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+func (in *VirtualServiceMerge) trackedKeys() []string {
+	keys := make([]string, 0)
+	if in.Spec.Target.IsSelector() {
+		// the status lists the routes of one of the targets, the ledger is the only record
+		return keys
+	}
+	for _, name := range in.Status.HttpRoutes {
+		keys = append(keys, httpLedgerKey(name))
+	}
+	for _, ref := range in.Status.TcpRoutes {
+		keys = append(keys, tcpLedgerKey(ref.Match))
+	}
+	for _, ref := range in.Status.TlsRoutes {
+		keys = append(keys, tlsLedgerKey(ref.Match))
+	}
+	if in.legacy() {
+		keys = append(keys, in.legacyKeys()...)
+	}
+	return keys
+}
+
+// legacy reports whether the merge was last handled by a release of the operator
+// recording neither the ledger nor the routes of the merge in its status
+func (in *VirtualServiceMerge) legacy() bool {
+	return in.Status.HandledRevision != "" && in.Status.ObservedGeneration == 0
+}
+
+// legacyKeys returns the keys of the routes a legacy merge wrote to its target: the http
+// routes by the names generated by then, the tcp and tls routes by their match
+func (in *VirtualServiceMerge) legacyKeys() []string {
+	keys := make([]string, 0)
+	routesCount := len(in.Spec.Patch.Http)
+	for i, r := range in.Spec.Patch.Http {
+		name := r.Name
+		if _, _, ok := parsePrecedence(logr.Discard(), name); !ok {
+			// the routes without a precedence suffix were named after the merge
+			name = fmt.Sprintf("%s-%d", in.Name, routesCount-i-1)
+		}
+		keys = append(keys, httpLedgerKey(name))
+	}
+	for _, ref := range in.TcpRouteRefs() {
+		keys = append(keys, tcpLedgerKey(ref.Match))
+	}
+	for _, ref := range in.TlsRouteRefs() {
+		keys = append(keys, tlsLedgerKey(ref.Match))
+	}
+	return keys
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestMerge(name string) *VirtualServiceMerge {
+	merge := &VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name + "-uid")}}
+	merge.Spec.Target.Name = "vs"
+	return merge
+}
+
+func httpRoute(name, dest string) *v1alpha3.HTTPRoute {
+	return &v1alpha3.HTTPRoute{
+		Name:  name,
+		Route: []*v1alpha3.HTTPRouteDestination{{Destination: &v1alpha3.Destination{Host: dest}}},
+	}
+}
+
+func httpDestinations(routes []*v1alpha3.HTTPRoute) []string {
+	dests := make([]string, len(routes))
+	for i, r := range routes {
+		dests[i] = r.Name + ":" + r.Route[0].Destination.Host
+	}
+	return dests
+}
+
+func TestAddHttpRoutesOwnership(t *testing.T) {
+	tests := []struct {
+		name string
+		// target are the routes of the target before the merge is applied
+		target []*v1alpha3.HTTPRoute
+		ledger OwnershipLedger
+		// tracked are the routes the status recorded before the ledger existed
+		tracked   []string
+		patch     []*v1alpha3.HTTPRoute
+		want      []string
+		owned     []string
+		protected []string
+	}{
+		{
+			name:   "adds new routes above the target routes",
+			target: []*v1alpha3.HTTPRoute{httpRoute("default", "base")},
+			ledger: OwnershipLedger{},
+			patch:  []*v1alpha3.HTTPRoute{httpRoute("api-1", "patch")},
+			want:   []string{"api-1:patch", "default:base"},
+			owned:  []string{"api-1"},
+		},
+		{
+			name:      "protects a foreign route with the same name",
+			target:    []*v1alpha3.HTTPRoute{httpRoute("api-1", "base")},
+			ledger:    OwnershipLedger{},
+			patch:     []*v1alpha3.HTTPRoute{httpRoute("api-1", "patch")},
+			want:      []string{"api-1:base"},
+			protected: []string{"http/api-1 (not managed by any merge)"},
+		},
+		{
+			name:   "protects a route owned by another merge",
+			target: []*v1alpha3.HTTPRoute{httpRoute("api-1", "other")},
+			ledger: OwnershipLedger{"http/api-1": {Namespace: "default", Name: "other", UID: "other-uid"}},
+			patch: []*v1alpha3.HTTPRoute{
+				httpRoute("api-1", "patch"),
+				httpRoute("web-0", "patch"),
+			},
+			want:      []string{"api-1:other", "web-0:patch"},
+			owned:     []string{"web-0"},
+			protected: []string{"http/api-1 (owned by default/other)"},
+		},
+		{
+			name:   "replaces its own route",
+			target: []*v1alpha3.HTTPRoute{httpRoute("api-1", "v1"), httpRoute("default", "base")},
+			ledger: OwnershipLedger{"http/api-1": {Namespace: "default", Name: "m", UID: "m-uid"}},
+			patch:  []*v1alpha3.HTTPRoute{httpRoute("api-1", "v2")},
+			want:   []string{"api-1:v2", "default:base"},
+			owned:  []string{"api-1"},
+		},
+		{
+			name: "drops the stale owned routes",
+			target: []*v1alpha3.HTTPRoute{
+				httpRoute("api-1", "v1"),
+				httpRoute("web-0", "v1"),
+				httpRoute("default", "base"),
+			},
+			ledger: OwnershipLedger{
+				"http/api-1": {Namespace: "default", Name: "m", UID: "m-uid"},
+				"http/web-0": {Namespace: "default", Name: "m", UID: "m-uid"},
+			},
+			patch: []*v1alpha3.HTTPRoute{httpRoute("api-1", "v2")},
+			want:  []string{"api-1:v2", "default:base"},
+			owned: []string{"api-1"},
+		},
+		{
+			name: "adopts the routes tracked in the status before the ledger",
+			target: []*v1alpha3.HTTPRoute{
+				httpRoute("api-1", "v1"),
+				httpRoute("web-0", "v1"),
+				httpRoute("default", "base"),
+			},
+			ledger:  OwnershipLedger{},
+			tracked: []string{"api-1", "web-0"},
+			patch:   []*v1alpha3.HTTPRoute{httpRoute("api-1", "v2")},
+			want:    []string{"api-1:v2", "default:base"},
+			owned:   []string{"api-1"},
+		},
+		{
+			name:    "does not take over a tracked route owned by another merge",
+			target:  []*v1alpha3.HTTPRoute{httpRoute("api-1", "other")},
+			ledger:  OwnershipLedger{"http/api-1": {Namespace: "default", Name: "other", UID: "other-uid"}},
+			tracked: []string{"api-1"},
+			want:    []string{"api-1:other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merge := newTestMerge("m")
+			merge.Spec.Patch.Http = tt.patch
+			merge.Status.HttpRoutes = tt.tracked
+			target := &alpha3.VirtualService{}
+			target.Spec.Http = tt.target
+			protected := merge.AddHttpRoutes(logr.Discard(), target, tt.ledger)
+			assertStrings(t, httpDestinations(target.Spec.Http), tt.want...)
+			assertStrings(t, protected, tt.protected...)
+			assertStrings(t, merge.Status.HttpRoutes, tt.owned...)
+			assertStrings(t, ownedRoutes(tt.ledger, merge), tt.owned...)
+		})
+	}
+}
+
+func TestRemoveHttpRoutes(t *testing.T) {
+	merge := newTestMerge("m")
+	merge.Status.HttpRoutes = []string{"legacy-2"}
+	target := &alpha3.VirtualService{}
+	target.Spec.Http = []*v1alpha3.HTTPRoute{
+		httpRoute("legacy-2", "m"),
+		httpRoute("api-1", "m"),
+		httpRoute("web-1", "other"),
+		httpRoute("default", "base"),
+	}
+	ledger := OwnershipLedger{
+		"http/api-1": {Namespace: "default", Name: "m", UID: "m-uid"},
+		"http/web-1": {Namespace: "default", Name: "other", UID: "other-uid"},
+	}
+	merge.RemoveHttpRoutes(logr.Discard(), target, ledger)
+	assertStrings(t, httpDestinations(target.Spec.Http), "web-1:other", "default:base")
+	if len(ledger) != 1 || ledger["http/web-1"].Name != "other" {
+		t.Errorf("ledger = %v, want only the route of the other merge", ledger)
+	}
+	if merge.Status.HttpRoutes != nil {
+		t.Errorf("status routes = %v, want none", merge.Status.HttpRoutes)
+	}
+}
+
+func TestAddTcpAndTlsRoutesOwnership(t *testing.T) {
+	tcp := func(dest string) *v1alpha3.TCPRoute {
+		return &v1alpha3.TCPRoute{
+			Match: []*v1alpha3.L4MatchAttributes{{Port: 5432}},
+			Route: []*v1alpha3.RouteDestination{{Destination: &v1alpha3.Destination{Host: dest}}},
+		}
+	}
+	tls := func(dest string) *v1alpha3.TLSRoute {
+		return &v1alpha3.TLSRoute{
+			Match: []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			Route: []*v1alpha3.RouteDestination{{Destination: &v1alpha3.Destination{Host: dest}}},
+		}
+	}
+	tests := []struct {
+		name    string
+		ledger  OwnershipLedger
+		tracked bool
+		want    string
+	}{
+		{name: "protects a foreign route with the same match", ledger: OwnershipLedger{}, want: "base"},
+		{name: "adopts a route tracked in the status", ledger: OwnershipLedger{}, tracked: true, want: "patch"},
+		{
+			name: "protects a route owned by another merge",
+			ledger: OwnershipLedger{
+				tcpLedgerKey(tcpMatchKey(tcp("").Match)): {Namespace: "default", Name: "other", UID: "other-uid"},
+				tlsLedgerKey(tlsMatchKey(tls("").Match)): {Namespace: "default", Name: "other", UID: "other-uid"},
+			},
+			tracked: true,
+			want:    "base",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merge := newTestMerge("m")
+			merge.Spec.Patch.Tcp = []*v1alpha3.TCPRoute{tcp("patch")}
+			merge.Spec.Patch.Tls = []*v1alpha3.TLSRoute{tls("patch")}
+			if tt.tracked {
+				merge.Status.TcpRoutes = merge.TcpRouteRefs()
+				merge.Status.TlsRoutes = merge.TlsRouteRefs()
+			}
+			target := &alpha3.VirtualService{}
+			target.Spec.Tcp = []*v1alpha3.TCPRoute{tcp("base")}
+			target.Spec.Tls = []*v1alpha3.TLSRoute{tls("base")}
+			protected := append(merge.AddTcpRoutes(target, tt.ledger), merge.AddTlsRoutes(target, tt.ledger)...)
+			if len(target.Spec.Tcp) != 1 || target.Spec.Tcp[0].Route[0].Destination.Host != tt.want {
+				t.Errorf("tcp routes = %v, want the %s route", target.Spec.Tcp, tt.want)
+			}
+			if len(target.Spec.Tls) != 1 || target.Spec.Tls[0].Route[0].Destination.Host != tt.want {
+				t.Errorf("tls routes = %v, want the %s route", target.Spec.Tls, tt.want)
+			}
+			if wantProtected := tt.want == "base"; (len(protected) == 2) != wantProtected {
+				t.Errorf("protected = %v, want protected = %v", protected, wantProtected)
+			}
+		})
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	tcp := func(dest string) *v1alpha3.TCPRoute {
+		return &v1alpha3.TCPRoute{
+			Match: []*v1alpha3.L4MatchAttributes{{Port: 5432}},
+			Route: []*v1alpha3.RouteDestination{{Destination: &v1alpha3.Destination{Host: dest}}},
+		}
+	}
+	// the merge as handled by a release without the ledger, which only recorded the handled revision
+	legacyMerge := func() *VirtualServiceMerge {
+		merge := newTestMerge("m")
+		merge.Status.HandledRevision = "1"
+		merge.Spec.Patch.Http = []*v1alpha3.HTTPRoute{httpRoute("api-1", "patch"), httpRoute("", "patch")}
+		merge.Spec.Patch.Tcp = []*v1alpha3.TCPRoute{tcp("patch")}
+		return merge
+	}
+	// the target as written by the legacy merge, without a ledger
+	legacyTarget := func() *alpha3.VirtualService {
+		target := &alpha3.VirtualService{}
+		target.Spec.Http = []*v1alpha3.HTTPRoute{httpRoute("api-1", "v1"), httpRoute("m-0", "v1"), httpRoute("default", "base")}
+		target.Spec.Tcp = []*v1alpha3.TCPRoute{tcp("v1")}
+		return target
+	}
+	tcpDestinations := func(routes []*v1alpha3.TCPRoute) []string {
+		dests := make([]string, len(routes))
+		for i, r := range routes {
+			dests[i] = r.Route[0].Destination.Host
+		}
+		return dests
+	}
+
+	t.Run("adopts the routes of a legacy merge", func(t *testing.T) {
+		merge, target := legacyMerge(), legacyTarget()
+		ledger, err := ReadLedger(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		protected := append(merge.AddTcpRoutes(target, ledger), merge.AddHttpRoutes(logr.Discard(), target, ledger)...)
+		assertStrings(t, protected)
+		assertStrings(t, httpDestinations(target.Spec.Http), "api-1:patch", "m-0:patch", "default:base")
+		assertStrings(t, tcpDestinations(target.Spec.Tcp), "patch")
+		assertStrings(t, ownedRoutes(ledger, merge), "api-1", "m-0")
+		if len(ledger) != 3 {
+			t.Errorf("ledger = %v, want the http and tcp routes of the merge", ledger)
+		}
+	})
+
+	t.Run("removes the routes of a deleted legacy merge", func(t *testing.T) {
+		merge, target := legacyMerge(), legacyTarget()
+		ledger := OwnershipLedger{}
+		merge.RemoveTcpRoutes(target, ledger)
+		merge.RemoveHttpRoutes(logr.Discard(), target, ledger)
+		assertStrings(t, httpDestinations(target.Spec.Http), "default:base")
+		assertStrings(t, tcpDestinations(target.Spec.Tcp))
+	})
+
+	t.Run("protects the same routes from a merge never handled", func(t *testing.T) {
+		merge, target := legacyMerge(), legacyTarget()
+		merge.Status.HandledRevision = ""
+		ledger := OwnershipLedger{}
+		protected := append(merge.AddTcpRoutes(target, ledger), merge.AddHttpRoutes(logr.Discard(), target, ledger)...)
+		if len(protected) != 3 {
+			t.Errorf("protected = %v, want the http and tcp routes of the target", protected)
+		}
+		assertStrings(t, httpDestinations(target.Spec.Http), "api-1:v1", "m-0:v1", "default:base")
+		assertStrings(t, tcpDestinations(target.Spec.Tcp), "v1")
+	})
+
+	t.Run("protects a legacy route adopted by another merge", func(t *testing.T) {
+		merge, target := legacyMerge(), legacyTarget()
+		ledger := OwnershipLedger{"http/api-1": {Namespace: "default", Name: "other", UID: "other-uid"}}
+		protected := merge.AddHttpRoutes(logr.Discard(), target, ledger)
+		assertStrings(t, protected, "http/api-1 (owned by default/other)")
+		assertStrings(t, httpDestinations(target.Spec.Http), "api-1:v1", "m-0:patch", "default:base")
+	})
+
+	t.Run("leaves the routes of a legacy merge out of the unmanaged routes", func(t *testing.T) {
+		merge, target := legacyMerge(), legacyTarget()
+		ledger := OwnershipLedger{}
+		ledger.Adopt(merge)
+		base := ledger.Unmanaged(&target.Spec)
+		assertStrings(t, httpDestinations(base.Http), "default:base")
+		assertStrings(t, tcpDestinations(base.Tcp))
+	})
+}
+
+func TestLedgerReadWrite(t *testing.T) {
+	target := &alpha3.VirtualService{}
+	ledger, err := ReadLedger(target)
+	if err != nil || len(ledger) != 0 {
+		t.Fatalf("ReadLedger() = %v, %v, want an empty ledger", ledger, err)
+	}
+	ledger.claim("http/api-1", newTestMerge("m"))
+	if err := ledger.Write(target); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLedger(target)
+	if err != nil || read["http/api-1"].UID != "m-uid" {
+		t.Fatalf("ReadLedger() = %v, %v, want the written ledger", read, err)
+	}
+	ledger.release(map[string]bool{"http/api-1": true})
+	if err := ledger.Write(target); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := target.Annotations[OwnershipAnnotation]; ok {
+		t.Errorf("annotation kept for an empty ledger")
+	}
+	target.Annotations = map[string]string{OwnershipAnnotation: "{"}
+	if _, err := ReadLedger(target); err == nil {
+		t.Errorf("ReadLedger() of an invalid annotation, want an error")
+	}
+}
+
+// ownedRoutes returns the names of the http routes the ledger attributes to the merge
+func ownedRoutes(ledger OwnershipLedger, merge *VirtualServiceMerge) []string {
+	names := make([]string, 0)
+	for key := range merge.ownedKeys(ledger, httpKind) {
+		names = append(names, strings.TrimPrefix(key, httpKind))
+	}
+	sort.Strings(names)
+	return names
+}
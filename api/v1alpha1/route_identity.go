@@ -0,0 +1,115 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+// tcpMatchKey computes the identity of a tcp route from all of its match attributes.
+// Two routes are the same route only when they match exactly the same traffic.
+func tcpMatchKey(matches []*v1alpha3.L4MatchAttributes) string {
+	keys := make([]string, 0, len(matches))
+	for _, m := range matches {
+		keys = append(keys, strings.Join([]string{
+			"port=" + strconv.FormatUint(uint64(m.Port), 10),
+			"destinationSubnets=" + sortedJoin(m.DestinationSubnets),
+			"sourceSubnet=" + m.SourceSubnet,
+			"sourceLabels=" + labelsKey(m.SourceLabels),
+			"gateways=" + sortedJoin(m.Gateways),
+			"sourceNamespace=" + m.SourceNamespace,
+		}, ";"))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "|")
+}
+
+func sortedJoin(values []string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func labelsKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	return sortedJoin(pairs)
+}
+
+// findRouteRef returns the reference with the given key
+func findRouteRef(refs []RouteRef, key string) (RouteRef, bool) {
+	for _, ref := range refs {
+		if ref.Key == key {
+			return ref, true
+		}
+	}
+	return RouteRef{}, false
+}
+
+// tlsMatchKey computes the identity of a tls route from all of its match attributes
+func tlsMatchKey(matches []*v1alpha3.TLSMatchAttributes) string {
+	keys := make([]string, 0, len(matches))
+	for _, m := range matches {
+		keys = append(keys, strings.Join([]string{
+			"sniHosts=" + sortedJoin(m.SniHosts),
+			"port=" + strconv.FormatUint(uint64(m.Port), 10),
+			"destinationSubnets=" + sortedJoin(m.DestinationSubnets),
+			"sourceLabels=" + labelsKey(m.SourceLabels),
+			"gateways=" + sortedJoin(m.Gateways),
+			"sourceNamespace=" + m.SourceNamespace,
+		}, ";"))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "|")
+}
+
+// TlsMatchesOverlap reports whether two tls routes can match the same connection,
+// i.e. they share a port and at least one SNI host, wildcards included.
+func TlsMatchesOverlap(matches1 []*v1alpha3.TLSMatchAttributes, matches2 []*v1alpha3.TLSMatchAttributes) bool {
+	for _, m1 := range matches1 {
+		for _, m2 := range matches2 {
+			if m1.Port != 0 && m2.Port != 0 && m1.Port != m2.Port {
+				continue
+			}
+			if len(m1.SniHosts) == 0 || len(m2.SniHosts) == 0 {
+				return true
+			}
+			for _, h1 := range m1.SniHosts {
+				for _, h2 := range m2.SniHosts {
+					if hostMatches(h1, h2) || hostMatches(h2, h1) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether the host is matched by the pattern which may be a wildcard host
+func hostMatches(pattern, host string) bool {
+	if pattern == host || pattern == "*" {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTcpMatchKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		m1, m2 []*v1alpha3.L4MatchAttributes
+		same   bool
+	}{
+		{
+			name: "same port, different destination subnets",
+			m1:   []*v1alpha3.L4MatchAttributes{{Port: 5432, DestinationSubnets: []string{"10.0.0.0/24"}}},
+			m2:   []*v1alpha3.L4MatchAttributes{{Port: 5432, DestinationSubnets: []string{"10.0.1.0/24"}}},
+		},
+		{
+			name: "same port, different source labels",
+			m1:   []*v1alpha3.L4MatchAttributes{{Port: 5432, SourceLabels: map[string]string{"app": "a"}}},
+			m2:   []*v1alpha3.L4MatchAttributes{{Port: 5432, SourceLabels: map[string]string{"app": "b"}}},
+		},
+		{
+			name: "same port, different source namespace",
+			m1:   []*v1alpha3.L4MatchAttributes{{Port: 5432, SourceNamespace: "a"}},
+			m2:   []*v1alpha3.L4MatchAttributes{{Port: 5432}},
+		},
+		{
+			name: "different ports",
+			m1:   []*v1alpha3.L4MatchAttributes{{Port: 5432}},
+			m2:   []*v1alpha3.L4MatchAttributes{{Port: 5433}},
+		},
+		{
+			name: "subnets and gateways in another order",
+			m1:   []*v1alpha3.L4MatchAttributes{{Port: 5432, DestinationSubnets: []string{"10.0.0.0/24", "10.0.1.0/24"}, Gateways: []string{"a", "b"}}},
+			m2:   []*v1alpha3.L4MatchAttributes{{Port: 5432, DestinationSubnets: []string{"10.0.1.0/24", "10.0.0.0/24"}, Gateways: []string{"b", "a"}}},
+			same: true,
+		},
+		{
+			name: "matches in another order",
+			m1:   []*v1alpha3.L4MatchAttributes{{Port: 5432}, {Port: 5433, SourceLabels: map[string]string{"app": "a", "v": "1"}}},
+			m2:   []*v1alpha3.L4MatchAttributes{{Port: 5433, SourceLabels: map[string]string{"v": "1", "app": "a"}}, {Port: 5432}},
+			same: true,
+		},
+		{
+			name: "no match",
+			same: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1, k2 := tcpMatchKey(tt.m1), tcpMatchKey(tt.m2)
+			if (k1 == k2) != tt.same {
+				t.Errorf("tcpMatchKey() = %q and %q, want same = %v", k1, k2, tt.same)
+			}
+		})
+	}
+}
+
+func TestAddTcpRoutes(t *testing.T) {
+	route := func(port uint32, subnet, dest string) *v1alpha3.TCPRoute {
+		return &v1alpha3.TCPRoute{
+			Match: []*v1alpha3.L4MatchAttributes{{Port: port, DestinationSubnets: []string{subnet}}},
+			Route: []*v1alpha3.RouteDestination{{Destination: &v1alpha3.Destination{Host: dest}}},
+		}
+	}
+	newMerge := func(keys []string, routes ...*v1alpha3.TCPRoute) *VirtualServiceMerge {
+		merge := &VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "m", UID: "m-uid"}}
+		merge.Spec.Target.Name = "vs"
+		merge.Spec.TcpRouteKeys = keys
+		merge.Spec.Patch.Tcp = routes
+		return merge
+	}
+	hosts := func(routes []*v1alpha3.TCPRoute) []string {
+		dests := make([]string, len(routes))
+		for i, r := range routes {
+			dests[i] = r.Route[0].Destination.Host
+		}
+		return dests
+	}
+
+	t.Run("same port and different subnets are distinct routes", func(t *testing.T) {
+		target := &alpha3.VirtualService{}
+		target.Spec.Tcp = []*v1alpha3.TCPRoute{route(5432, "10.0.0.0/24", "base")}
+		ledger := OwnershipLedger{}
+		protected := newMerge(nil, route(5432, "10.0.1.0/24", "patch")).AddTcpRoutes(target, ledger)
+		if len(protected) != 0 {
+			t.Fatalf("AddTcpRoutes() protected = %v, want none", protected)
+		}
+		assertStrings(t, hosts(target.Spec.Tcp), "base", "patch")
+	})
+
+	t.Run("keyed route replaces its previous route after a match change", func(t *testing.T) {
+		target := &alpha3.VirtualService{}
+		target.Spec.Tcp = []*v1alpha3.TCPRoute{route(5432, "10.0.0.0/24", "base")}
+		ledger := OwnershipLedger{}
+		merge := newMerge([]string{"db"}, route(5433, "10.0.1.0/24", "v1"))
+		merge.AddTcpRoutes(target, ledger)
+		target.Spec.Tcp = append(target.Spec.Tcp, route(5434, "10.0.0.0/24", "other"))
+
+		merge.Spec.Patch.Tcp = []*v1alpha3.TCPRoute{route(5433, "10.0.2.0/24", "v2")}
+		if protected := merge.AddTcpRoutes(target, ledger); len(protected) != 0 {
+			t.Fatalf("AddTcpRoutes() protected = %v, want none", protected)
+		}
+		// replaced in place rather than dropped and appended
+		assertStrings(t, hosts(target.Spec.Tcp), "base", "v2", "other")
+		if len(ledger) != 1 {
+			t.Errorf("ledger = %v, want the new match only", ledger)
+		}
+		if refs := merge.Status.TcpRoutes; len(refs) != 1 || refs[0].Key != "db" || refs[0].Match != tcpMatchKey(target.Spec.Tcp[1].Match) {
+			t.Errorf("status routes = %v, want the db route with its new match", refs)
+		}
+	})
+}
+
+func assertStrings(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestTlsMatchKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		m1, m2 []*v1alpha3.TLSMatchAttributes
+		same   bool
+	}{
+		{
+			name: "same port, different sni hosts",
+			m1:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			m2:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"b.example.com"}}},
+		},
+		{
+			name: "same sni hosts, different source labels",
+			m1:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}, SourceLabels: map[string]string{"app": "a"}}},
+			m2:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+		},
+		{
+			name: "sni hosts in another order",
+			m1:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com", "b.example.com"}}},
+			m2:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"b.example.com", "a.example.com"}}},
+			same: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1, k2 := tlsMatchKey(tt.m1), tlsMatchKey(tt.m2)
+			if (k1 == k2) != tt.same {
+				t.Errorf("tlsMatchKey() = %q and %q, want same = %v", k1, k2, tt.same)
+			}
+		})
+	}
+}
+
+func TestTlsMatchesOverlap(t *testing.T) {
+	tests := []struct {
+		name    string
+		m1, m2  []*v1alpha3.TLSMatchAttributes
+		overlap bool
+	}{
+		{
+			name: "different sni hosts on 443",
+			m1:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			m2:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"b.example.com"}}},
+		},
+		{
+			name:    "same sni host on 443",
+			m1:      []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			m2:      []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"b.example.com", "a.example.com"}}},
+			overlap: true,
+		},
+		{
+			name:    "wildcard overlapping a host",
+			m1:      []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"*.example.com"}}},
+			m2:      []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			overlap: true,
+		},
+		{
+			name:    "host overlapped by a wildcard",
+			m1:      []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			m2:      []*v1alpha3.TLSMatchAttributes{{SniHosts: []string{"*"}}},
+			overlap: true,
+		},
+		{
+			name: "wildcard of another domain",
+			m1:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"*.example.org"}}},
+			m2:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+		},
+		{
+			name: "same sni host on different ports",
+			m1:   []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			m2:   []*v1alpha3.TLSMatchAttributes{{Port: 8443, SniHosts: []string{"a.example.com"}}},
+		},
+		{
+			name:    "no sni host",
+			m1:      []*v1alpha3.TLSMatchAttributes{{Port: 443}},
+			m2:      []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: []string{"a.example.com"}}},
+			overlap: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TlsMatchesOverlap(tt.m1, tt.m2); got != tt.overlap {
+				t.Errorf("TlsMatchesOverlap() = %v, want %v", got, tt.overlap)
+			}
+		})
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"a.example.com", "a.example.com", true},
+		{"*", "a.example.com", true},
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.example.org", false},
+		{"a.example.com", "*.example.com", false},
+		{"a.example.com", "b.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := hostMatches(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
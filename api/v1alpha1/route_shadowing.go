@@ -0,0 +1,167 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+// ShadowedRoutes returns the http routes the merge contributed to the target which can
+// never be reached, because an earlier route of the target matches all of their requests.
+func (in *VirtualServiceMerge) ShadowedRoutes(target *alpha3.VirtualService) []string {
+	contributed := map[string]bool{}
+	for _, name := range in.Status.HttpRoutes {
+		contributed[name] = true
+	}
+	shadowed := make([]string, 0)
+	for i, route := range target.Spec.Http {
+		if !contributed[route.Name] {
+			continue
+		}
+		for _, earlier := range target.Spec.Http[:i] {
+			if routeShadows(earlier, route) {
+				shadowed = append(shadowed, fmt.Sprintf("%s (shadowed by %s)", route.Name, earlier.Name))
+				break
+			}
+		}
+	}
+	return shadowed
+}
+
+// routeShadows reports whether every request matched by the route is matched by the earlier route
+func routeShadows(earlier, route *v1alpha3.HTTPRoute) bool {
+	matches, earlierMatches := route.Match, earlier.Match
+	// a route without match matches every request
+	if len(matches) == 0 {
+		matches = []*v1alpha3.HTTPMatchRequest{{}}
+	}
+	if len(earlierMatches) == 0 {
+		earlierMatches = []*v1alpha3.HTTPMatchRequest{{}}
+	}
+outer:
+	for _, m := range matches {
+		for _, em := range earlierMatches {
+			if matchCovers(em, m) {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchCovers reports whether the match m1 matches a superset of the requests the match m2 does.
+// It errs on the side of not covering when it cannot tell.
+func matchCovers(m1, m2 *v1alpha3.HTTPMatchRequest) bool {
+	if len(m1.WithoutHeaders) > 0 {
+		return false
+	}
+	if !uriCovers(m1, m2) || !stringCovers(m1.Method, m2.Method) ||
+		!stringCovers(m1.Authority, m2.Authority) || !stringCovers(m1.Scheme, m2.Scheme) {
+		return false
+	}
+	if m1.Port != 0 && m1.Port != m2.Port {
+		return false
+	}
+	if m1.SourceNamespace != "" && m1.SourceNamespace != m2.SourceNamespace {
+		return false
+	}
+	if !stringsCover(m1.Headers, m2.Headers) || !stringsCover(m1.QueryParams, m2.QueryParams) {
+		return false
+	}
+	for key, value := range m1.SourceLabels {
+		if v, ok := m2.SourceLabels[key]; !ok || v != value {
+			return false
+		}
+	}
+	if len(m1.Gateways) > 0 {
+		if len(m2.Gateways) == 0 {
+			return false
+		}
+		for _, gateway := range m2.Gateways {
+			if !containsValue(m1.Gateways, gateway) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// uriCovers reports whether the uri match of m1 matches every uri the uri match of m2 does
+func uriCovers(m1, m2 *v1alpha3.HTTPMatchRequest) bool {
+	// every uri starts with the root prefix, whatever its case
+	if prefix, ok := m1.Uri.GetMatchType().(*v1alpha3.StringMatch_Prefix); ok && prefix.Prefix == "/" {
+		return true
+	}
+	if m1.Uri != nil && m2.IgnoreUriCase && !m1.IgnoreUriCase {
+		return false
+	}
+	return stringCovers(m1.Uri, m2.Uri)
+}
+
+// stringsCover reports whether every keyed condition of m1 covers the condition of m2 with the same key
+func stringsCover(m1, m2 map[string]*v1alpha3.StringMatch) bool {
+	for key, s1 := range m1 {
+		s2, ok := m2[key]
+		if !ok || !stringCovers(s1, s2) {
+			return false
+		}
+	}
+	return true
+}
+
+// stringCovers reports whether the string match s1 matches every string the match s2 does
+func stringCovers(s1, s2 *v1alpha3.StringMatch) bool {
+	if s1 == nil || s1.GetMatchType() == nil {
+		return true
+	}
+	// the empty prefix matches any string
+	if prefix, ok := s1.GetMatchType().(*v1alpha3.StringMatch_Prefix); ok && prefix.Prefix == "" {
+		return true
+	}
+	if s2 == nil || s2.GetMatchType() == nil {
+		return false
+	}
+	switch m1 := s1.GetMatchType().(type) {
+	case *v1alpha3.StringMatch_Prefix:
+		switch m2 := s2.GetMatchType().(type) {
+		case *v1alpha3.StringMatch_Prefix:
+			return strings.HasPrefix(m2.Prefix, m1.Prefix)
+		case *v1alpha3.StringMatch_Exact:
+			return strings.HasPrefix(m2.Exact, m1.Prefix)
+		}
+	case *v1alpha3.StringMatch_Exact:
+		if m2, ok := s2.GetMatchType().(*v1alpha3.StringMatch_Exact); ok {
+			return m1.Exact == m2.Exact
+		}
+	case *v1alpha3.StringMatch_Regex:
+		switch m2 := s2.GetMatchType().(type) {
+		case *v1alpha3.StringMatch_Regex:
+			return m1.Regex == m2.Regex
+		case *v1alpha3.StringMatch_Exact:
+			// istio regexes match the whole string
+			re, err := regexp.Compile("^(?:" + m1.Regex + ")$")
+			return err == nil && re.MatchString(m2.Exact)
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+func TestStringCovers(t *testing.T) {
+	prefix := func(s string) *v1alpha3.StringMatch {
+		return &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Prefix{Prefix: s}}
+	}
+	exact := func(s string) *v1alpha3.StringMatch {
+		return &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Exact{Exact: s}}
+	}
+	regex := func(s string) *v1alpha3.StringMatch {
+		return &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Regex{Regex: s}}
+	}
+	tests := []struct {
+		name   string
+		s1, s2 *v1alpha3.StringMatch
+		want   bool
+	}{
+		{"no condition covers anything", nil, exact("/a"), true},
+		{"empty condition covers anything", &v1alpha3.StringMatch{}, prefix("/a"), true},
+		{"a condition does not cover no condition", prefix("/a"), nil, false},
+		{"the empty prefix covers no condition", prefix(""), nil, true},
+		{"the empty prefix covers a regex", prefix(""), regex("/.*"), true},
+		{"prefix covers a longer prefix", prefix("/"), prefix("/reviews"), true},
+		{"prefix does not cover a shorter prefix", prefix("/reviews"), prefix("/"), false},
+		{"prefix covers an exact match it starts", prefix("/reviews"), exact("/reviews/1"), true},
+		{"prefix does not cover another exact match", prefix("/reviews"), exact("/products"), false},
+		{"prefix does not cover a regex", prefix("/"), regex("/.*"), false},
+		{"exact covers the same exact match", exact("/a"), exact("/a"), true},
+		{"exact does not cover another exact match", exact("/a"), exact("/b"), false},
+		{"exact does not cover a prefix", exact("/a"), prefix("/a"), false},
+		{"regex covers the same regex", regex("/a.*"), regex("/a.*"), true},
+		{"regex covers an exact match it matches", regex("/reviews/[0-9]+"), exact("/reviews/12"), true},
+		{"regex matches the whole string", regex("/reviews"), exact("/reviews/12"), false},
+		{"invalid regex covers nothing", regex("("), exact("("), false},
+		{"regex does not cover a prefix", regex("/.*"), prefix("/a"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringCovers(tt.s1, tt.s2); got != tt.want {
+				t.Errorf("stringCovers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchCovers(t *testing.T) {
+	header := func(match *v1alpha3.HTTPMatchRequest, value string) *v1alpha3.HTTPMatchRequest {
+		match.Headers = map[string]*v1alpha3.StringMatch{"x-version": {MatchType: &v1alpha3.StringMatch_Exact{Exact: value}}}
+		return match
+	}
+	ignoreCase := func(match *v1alpha3.HTTPMatchRequest) *v1alpha3.HTTPMatchRequest {
+		match.IgnoreUriCase = true
+		return match
+	}
+	tests := []struct {
+		name   string
+		m1, m2 *v1alpha3.HTTPMatchRequest
+		want   bool
+	}{
+		{"no match covers anything", &v1alpha3.HTTPMatchRequest{}, header(exactMatch("/a"), "v1"), true},
+		{"the / prefix covers /reviews", prefixMatch("/"), prefixMatch("/reviews"), true},
+		{"/reviews does not cover the / prefix", prefixMatch("/reviews"), prefixMatch("/"), false},
+		{"a match without header covers one with a header", prefixMatch("/"), header(prefixMatch("/reviews"), "v1"), true},
+		{"a match with a header does not cover one without", header(prefixMatch("/"), "v1"), prefixMatch("/reviews"), false},
+		{"the same header", header(prefixMatch("/"), "v1"), header(prefixMatch("/reviews"), "v1"), true},
+		{"another header value", header(prefixMatch("/"), "v1"), header(prefixMatch("/reviews"), "v2"), false},
+		{"without headers cover nothing", &v1alpha3.HTTPMatchRequest{WithoutHeaders: map[string]*v1alpha3.StringMatch{"x": {}}}, prefixMatch("/"), false},
+		{"a port does not cover another port", &v1alpha3.HTTPMatchRequest{Port: 80}, &v1alpha3.HTTPMatchRequest{Port: 8080}, false},
+		{"a port covers the same port", &v1alpha3.HTTPMatchRequest{Port: 80}, &v1alpha3.HTTPMatchRequest{Port: 80, Uri: prefixMatch("/").Uri}, true},
+		{"no port covers any port", prefixMatch("/"), &v1alpha3.HTTPMatchRequest{Port: 80, Uri: prefixMatch("/a").Uri}, true},
+		{"a gateway does not cover the mesh", &v1alpha3.HTTPMatchRequest{Gateways: []string{"gw"}}, prefixMatch("/"), false},
+		{"gateways cover a subset", &v1alpha3.HTTPMatchRequest{Gateways: []string{"gw", "mesh"}}, &v1alpha3.HTTPMatchRequest{Gateways: []string{"gw"}}, true},
+		{"gateways do not cover other gateways", &v1alpha3.HTTPMatchRequest{Gateways: []string{"gw"}}, &v1alpha3.HTTPMatchRequest{Gateways: []string{"gw", "mesh"}}, false},
+		{"source labels cover more labels", &v1alpha3.HTTPMatchRequest{SourceLabels: map[string]string{"app": "a"}}, &v1alpha3.HTTPMatchRequest{SourceLabels: map[string]string{"app": "a", "v": "1"}}, true},
+		{"source labels do not cover other labels", &v1alpha3.HTTPMatchRequest{SourceLabels: map[string]string{"app": "a"}}, &v1alpha3.HTTPMatchRequest{SourceLabels: map[string]string{"app": "b"}}, false},
+		{"a source namespace does not cover another", &v1alpha3.HTTPMatchRequest{SourceNamespace: "a"}, &v1alpha3.HTTPMatchRequest{SourceNamespace: "b"}, false},
+		{"the / prefix covers no uri", prefixMatch("/"), &v1alpha3.HTTPMatchRequest{Method: prefixMatch("GET").Uri}, true},
+		{"the / prefix covers a regex", prefixMatch("/"), regexMatch("/.*"), true},
+		{"the / prefix covers an ignored case", prefixMatch("/"), ignoreCase(prefixMatch("/reviews")), true},
+		{"a case sensitive uri does not cover an ignored case", prefixMatch("/r"), ignoreCase(prefixMatch("/reviews")), false},
+		{"the / prefix is only the root of a uri", &v1alpha3.HTTPMatchRequest{Authority: prefixMatch("/").Uri}, prefixMatch("/"), false},
+		{"an ignored case uri covers a case sensitive one", ignoreCase(prefixMatch("/")), prefixMatch("/reviews"), true},
+		{"no uri covers an ignored case", &v1alpha3.HTTPMatchRequest{}, ignoreCase(prefixMatch("/reviews")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchCovers(tt.m1, tt.m2); got != tt.want {
+				t.Errorf("matchCovers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShadowedRoutes(t *testing.T) {
+	target := &alpha3.VirtualService{}
+	target.Spec.Http = []*v1alpha3.HTTPRoute{
+		matchRoute("root-10", prefixMatch("/")),
+		matchRoute("reviews-1", prefixMatch("/reviews")),
+		matchRoute("products-1", exactMatch("/products"), prefixMatch("/products/")),
+		matchRoute("canary-1", &v1alpha3.HTTPMatchRequest{Headers: map[string]*v1alpha3.StringMatch{"x-canary": {}}}),
+		matchRoute("default"),
+	}
+	merge := newTestMerge("m")
+	merge.Status.HttpRoutes = []string{"reviews-1", "products-1", "canary-1", "default"}
+	// the / prefix matches any uri, even the requests of routes without uri match
+	assertStrings(t, merge.ShadowedRoutes(target),
+		"reviews-1 (shadowed by root-10)",
+		"products-1 (shadowed by root-10)",
+		"canary-1 (shadowed by root-10)",
+		"default (shadowed by root-10)",
+	)
+
+	// a route is shadowed only when all of its matches are covered
+	target.Spec.Http[0] = matchRoute("root-10", exactMatch("/products"))
+	assertStrings(t, merge.ShadowedRoutes(target))
+	target.Spec.Http[0] = matchRoute("root-10", exactMatch("/products"), prefixMatch("/products"))
+	assertStrings(t, merge.ShadowedRoutes(target), "products-1 (shadowed by root-10)")
+
+	// a route without match is not known to be covered by a longer uri match
+	target.Spec.Http[0] = matchRoute("root-10", prefixMatch("/a"))
+	assertStrings(t, merge.ShadowedRoutes(target))
+
+	// only the routes of the merge are reported
+	target.Spec.Http = append([]*v1alpha3.HTTPRoute{matchRoute("catch-all")}, target.Spec.Http[1:]...)
+	merge.Status.HttpRoutes = []string{"default"}
+	assertStrings(t, merge.ShadowedRoutes(target), "default (shadowed by catch-all)")
+}
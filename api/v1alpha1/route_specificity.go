@@ -0,0 +1,109 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+const (
+	// RouteOrderingAnnotation is the target annotation selecting how its http routes are ordered
+	RouteOrderingAnnotation = "istiomerger.monime.sl/route-ordering"
+	// OrderByPrecedence orders the http routes by their priority, the default
+	OrderByPrecedence = "precedence"
+	// OrderBySpecificity orders the http routes by the specificity of their matches,
+	// then by their priority, keeping the catch-all routes of the target last
+	OrderBySpecificity = "specificity"
+)
+
+// RouteOrdering returns the ordering of the http routes selected on the target
+func RouteOrdering(target *alpha3.VirtualService) string {
+	if target.Annotations[RouteOrderingAnnotation] == OrderBySpecificity {
+		return OrderBySpecificity
+	}
+	return OrderByPrecedence
+}
+
+// the kinds of uri match, from the least to the most specific
+const (
+	uriNone = iota
+	uriPrefix
+	uriRegex
+	uriExact
+)
+
+// specificity ranks a match: the kind of its uri match first, then the
+// length of its uri prefix, then the number of its other conditions.
+// +kubebuilder:object:generate=false
+type specificity struct {
+	uri        int
+	length     int
+	conditions int
+}
+
+func (in specificity) less(other specificity) bool {
+	if in.uri != other.uri {
+		return in.uri < other.uri
+	}
+	if in.length != other.length {
+		return in.length < other.length
+	}
+	return in.conditions < other.conditions
+}
+
+// catchAll reports whether the match matches every request
+func (in specificity) catchAll() bool {
+	return in.conditions == 0 && in.uri == uriNone
+}
+
+func matchSpecificity(m *v1alpha3.HTTPMatchRequest) specificity {
+	s := specificity{}
+	switch uri := m.GetUri().GetMatchType().(type) {
+	case *v1alpha3.StringMatch_Exact:
+		s.uri, s.length = uriExact, len(uri.Exact)
+	case *v1alpha3.StringMatch_Regex:
+		s.uri = uriRegex
+	case *v1alpha3.StringMatch_Prefix:
+		// the root prefix matches any uri, as no uri match at all
+		if uri.Prefix != "" && uri.Prefix != "/" {
+			s.uri, s.length = uriPrefix, len(uri.Prefix)
+		}
+	}
+	s.conditions = len(m.Headers) + len(m.QueryParams) + len(m.WithoutHeaders) + len(m.SourceLabels) + len(m.Gateways)
+	for _, set := range []bool{m.Method != nil, m.Authority != nil, m.Scheme != nil, m.Port != 0, m.SourceNamespace != ""} {
+		if set {
+			s.conditions++
+		}
+	}
+	return s
+}
+
+// routeSpecificity is the specificity of the least specific match of the route,
+// as a route is as broad as the broadest request it matches.
+func routeSpecificity(r *v1alpha3.HTTPRoute) specificity {
+	if len(r.Match) == 0 {
+		return specificity{}
+	}
+	least := matchSpecificity(r.Match[0])
+	for _, m := range r.Match[1:] {
+		if s := matchSpecificity(m); s.less(least) {
+			least = s
+		}
+	}
+	return least
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"istio.io/api/networking/v1alpha3"
+)
+
+func prefixMatch(prefix string) *v1alpha3.HTTPMatchRequest {
+	return &v1alpha3.HTTPMatchRequest{Uri: &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Prefix{Prefix: prefix}}}
+}
+
+func exactMatch(exact string) *v1alpha3.HTTPMatchRequest {
+	return &v1alpha3.HTTPMatchRequest{Uri: &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Exact{Exact: exact}}}
+}
+
+func regexMatch(regex string) *v1alpha3.HTTPMatchRequest {
+	return &v1alpha3.HTTPMatchRequest{Uri: &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Regex{Regex: regex}}}
+}
+
+func matchRoute(name string, matches ...*v1alpha3.HTTPMatchRequest) *v1alpha3.HTTPRoute {
+	route := httpRoute(name, name)
+	route.Match = matches
+	return route
+}
+
+func TestSanitizeRoutes(t *testing.T) {
+	withHeader := prefixMatch("/reviews")
+	withHeader.Headers = map[string]*v1alpha3.StringMatch{"x-version": {MatchType: &v1alpha3.StringMatch_Exact{Exact: "v2"}}}
+	headerOnly := &v1alpha3.HTTPMatchRequest{Headers: withHeader.Headers}
+	tests := []struct {
+		name     string
+		routes   []*v1alpha3.HTTPRoute
+		merged   map[string]int32
+		ordering string
+		want     []string
+	}{
+		{
+			name:     "by precedence the priority wins over the specificity",
+			routes:   []*v1alpha3.HTTPRoute{matchRoute("reviews", prefixMatch("/reviews")), matchRoute("root", prefixMatch("/"))},
+			merged:   map[string]int32{"reviews": 0, "root": 10},
+			ordering: OrderByPrecedence,
+			want:     []string{"root", "reviews"},
+		},
+		{
+			name:     "by specificity the longer prefix comes first",
+			routes:   []*v1alpha3.HTTPRoute{matchRoute("root", prefixMatch("/")), matchRoute("reviews", prefixMatch("/reviews"))},
+			merged:   map[string]int32{"reviews": 0, "root": 10},
+			ordering: OrderBySpecificity,
+			want:     []string{"reviews", "root"},
+		},
+		{
+			name: "exact, then regex, then prefix uri matches",
+			routes: []*v1alpha3.HTTPRoute{
+				matchRoute("prefix", prefixMatch("/reviews/v2/long")),
+				matchRoute("regex", regexMatch("/reviews/.*")),
+				matchRoute("exact", exactMatch("/r")),
+			},
+			merged:   map[string]int32{"prefix": 0, "regex": 0, "exact": 0},
+			ordering: OrderBySpecificity,
+			want:     []string{"exact", "regex", "prefix"},
+		},
+		{
+			name:     "more conditions come first",
+			routes:   []*v1alpha3.HTTPRoute{matchRoute("reviews", prefixMatch("/reviews")), matchRoute("reviews-v2", withHeader)},
+			merged:   map[string]int32{"reviews": 0, "reviews-v2": 0},
+			ordering: OrderBySpecificity,
+			want:     []string{"reviews-v2", "reviews"},
+		},
+		{
+			name:     "a header match comes before the root prefix",
+			routes:   []*v1alpha3.HTTPRoute{matchRoute("root", prefixMatch("/")), matchRoute("canary", headerOnly), matchRoute("empty", prefixMatch(""))},
+			merged:   map[string]int32{"root": 10, "canary": 0, "empty": 5},
+			ordering: OrderBySpecificity,
+			want:     []string{"canary", "root", "empty"},
+		},
+		{
+			name:     "a route is as specific as its broadest match",
+			routes:   []*v1alpha3.HTTPRoute{matchRoute("both", exactMatch("/reviews/1"), prefixMatch("/")), matchRoute("reviews", prefixMatch("/reviews"))},
+			merged:   map[string]int32{"both": 0, "reviews": 0},
+			ordering: OrderBySpecificity,
+			want:     []string{"reviews", "both"},
+		},
+		{
+			name:     "the priority breaks ties",
+			routes:   []*v1alpha3.HTTPRoute{matchRoute("low", prefixMatch("/a")), matchRoute("high", prefixMatch("/b"))},
+			merged:   map[string]int32{"low": 1, "high": 2},
+			ordering: OrderBySpecificity,
+			want:     []string{"high", "low"},
+		},
+		{
+			name: "the catch-all routes of the base stay last, in their order",
+			routes: []*v1alpha3.HTTPRoute{
+				matchRoute("default"),
+				matchRoute("base-root", prefixMatch("/")),
+				matchRoute("merged-catch-all"),
+				matchRoute("reviews", prefixMatch("/reviews")),
+				matchRoute("base-reviews", prefixMatch("/reviews/v1")),
+			},
+			merged:   map[string]int32{"merged-catch-all": -5, "reviews": 0},
+			ordering: OrderBySpecificity,
+			want:     []string{"base-reviews", "reviews", "merged-catch-all", "default", "base-root"},
+		},
+		{
+			name:     "unmerged routes are ordered by their name suffix",
+			routes:   []*v1alpha3.HTTPRoute{matchRoute("a-1", prefixMatch("/a")), matchRoute("b-2", prefixMatch("/b")), matchRoute("c", prefixMatch("/c"))},
+			ordering: OrderBySpecificity,
+			want:     []string{"b-2", "a-1", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := OwnershipLedger{}
+			for name, priority := range tt.merged {
+				priority := priority
+				ledger.claimRoute(httpLedgerKey(name), newTestMerge("m"), &priority)
+			}
+			routes := sanitizeRoutes(logr.Discard(), tt.routes, ledger, tt.ordering)
+			assertStrings(t, routeNames(routes), tt.want...)
+		})
+	}
+}
+
+func routeNames(routes []*v1alpha3.HTTPRoute) []string {
+	names := make([]string, len(routes))
+	for i, r := range routes {
+		names[i] = r.Name
+	}
+	return names
+}
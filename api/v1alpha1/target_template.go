@@ -0,0 +1,64 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CreatedAnnotation marks the target VirtualServices created by the operator from a template
+const CreatedAnnotation = "istiomerger.monime.sl/created"
+
+// TargetTemplate is the spec of the target VirtualService created when missing
+type TargetTemplate struct {
+	// +kubebuilder:validation:MinItems=1
+	Hosts []string `json:"hosts"`
+	// +optional
+	Gateways []string `json:"gateways,omitempty"`
+	// DefaultRoute is the http route of the created VirtualService, the merged routes are placed before it
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +optional
+	DefaultRoute *v1alpha3.HTTPRoute `json:"defaultRoute,omitempty"`
+}
+
+// NewVirtualService returns the VirtualService to create from the template of the target
+func (in *Target) NewVirtualService(ref TargetReference) *alpha3.VirtualService {
+	vs := &alpha3.VirtualService{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ref.Name,
+			Namespace:   ref.Namespace,
+			Annotations: map[string]string{CreatedAnnotation: "true"},
+		},
+	}
+	if in.Template == nil {
+		return vs
+	}
+	vs.Spec.Hosts = append(vs.Spec.Hosts, in.Template.Hosts...)
+	vs.Spec.Gateways = append(vs.Spec.Gateways, in.Template.Gateways...)
+	if in.Template.DefaultRoute != nil {
+		vs.Spec.Http = []*v1alpha3.HTTPRoute{in.Template.DefaultRoute.DeepCopy()}
+	}
+	return vs
+}
+
+// IsCreated reports whether the VirtualService was created by the operator from a template
+func IsCreated(vs *alpha3.VirtualService) bool {
+	return vs.Annotations[CreatedAnnotation] == "true"
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"strings"
+
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// MergeField is a list field of the patch which can be merged into the target besides the routes
+// +kubebuilder:validation:Enum=hosts;gateways;exportTo
+type MergeField string
+
+const (
+	MergeFieldHosts    MergeField = "hosts"
+	MergeFieldGateways MergeField = "gateways"
+	MergeFieldExportTo MergeField = "exportTo"
+)
+
+// AddListFields merges the values of the opted-in list fields of the patch into the
+// target. A value already in the target is shared with the merges contributing it
+// too, unless it was not added by a merge in which case it is left unmanaged.
+func (in *VirtualServiceMerge) AddListFields(target *alpha3.VirtualService, ledger OwnershipLedger) {
+	target.Spec.Hosts, in.Status.Hosts = in.addValues(ledger, MergeFieldHosts, target.Spec.Hosts, in.Spec.Patch.Hosts)
+	target.Spec.Gateways, in.Status.Gateways = in.addValues(ledger, MergeFieldGateways, target.Spec.Gateways, in.Spec.Patch.Gateways)
+	target.Spec.ExportTo, in.Status.ExportTo = in.addValues(ledger, MergeFieldExportTo, target.Spec.ExportTo, in.Spec.Patch.ExportTo)
+}
+
+// RemoveListFields removes from the target the values the merge contributed
+// and no other merge contributes.
+func (in *VirtualServiceMerge) RemoveListFields(target *alpha3.VirtualService, ledger OwnershipLedger) {
+	target.Spec.Hosts = releaseValues(ledger, MergeFieldHosts, target.Spec.Hosts, in.ownedKeys(ledger, string(MergeFieldHosts)+"/"))
+	target.Spec.Gateways = releaseValues(ledger, MergeFieldGateways, target.Spec.Gateways, in.ownedKeys(ledger, string(MergeFieldGateways)+"/"))
+	target.Spec.ExportTo = releaseValues(ledger, MergeFieldExportTo, target.Spec.ExportTo, in.ownedKeys(ledger, string(MergeFieldExportTo)+"/"))
+	in.Status.Hosts, in.Status.Gateways, in.Status.ExportTo = nil, nil, nil
+}
+
+func (in *VirtualServiceMerge) mergesField(field MergeField) bool {
+	for _, f := range in.Spec.MergeFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (in *VirtualServiceMerge) addValues(ledger OwnershipLedger, field MergeField, values, patchValues []string) ([]string, []string) {
+	if !in.mergesField(field) {
+		// the previous contributions are still released when opting out
+		patchValues = nil
+	}
+	stale := in.ownedKeys(ledger, string(field)+"/")
+	contributed := make([]string, 0)
+	for _, value := range patchValues {
+		if containsValue(values, value) && !ledger.hasValue(field, value) {
+			// not added by any merge
+			continue
+		}
+		if !containsValue(values, value) {
+			values = append(values, value)
+		}
+		key := fieldLedgerKey(field, value, in.UID)
+		ledger.claim(key, in)
+		delete(stale, key)
+		contributed = append(contributed, value)
+	}
+	return releaseValues(ledger, field, values, stale), contributed
+}
+
+// releaseValues drops the ledger keys and removes from the values the ones no merge contributes anymore
+func releaseValues(ledger OwnershipLedger, field MergeField, values []string, keys map[string]bool) []string {
+	released := map[string]bool{}
+	for key := range keys {
+		released[fieldValue(key, ledger[key], field)] = true
+	}
+	ledger.release(keys)
+	kept := make([]string, 0, len(values))
+	for _, value := range values {
+		if released[value] && !ledger.hasValue(field, value) {
+			continue
+		}
+		kept = append(kept, value)
+	}
+	return kept
+}
+
+// fieldLedgerKey keys a list field value per contributing merge, so that the value
+// is reference counted by the number of merges contributing it.
+func fieldLedgerKey(field MergeField, value string, uid types.UID) string {
+	return string(field) + "/" + value + "/" + string(uid)
+}
+
+// hasValue reports whether any merge contributes the value of the field
+func (in OwnershipLedger) hasValue(field MergeField, value string) bool {
+	for key, owner := range in {
+		if fieldValue(key, owner, field) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValue returns the value of a list field ledger key, empty for other keys.
+// The key is split with the UID of its owner since both the value, e.g. a
+// namespaced gateway, and the UID may contain a '/'.
+func fieldValue(key string, owner RouteOwner, field MergeField) string {
+	prefix, suffix := string(field)+"/", "/"+string(owner.UID)
+	if len(key) <= len(prefix)+len(suffix) || !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) {
+		return ""
+	}
+	return key[len(prefix) : len(key)-len(suffix)]
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeValues(values []string, ledger OwnershipLedger, field MergeField) []string {
+	kept := make([]string, 0, len(values))
+	for _, value := range values {
+		if !ledger.hasValue(field, value) {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
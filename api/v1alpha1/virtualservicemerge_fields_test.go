@@ -0,0 +1,107 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"testing"
+
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestListFields(t *testing.T) {
+	// the uids of the merges rendered by the CLI contain a '/', like the namespaced gateways
+	for _, uid := range []string{"uid", "default/m"} {
+		t.Run(uid, func(t *testing.T) {
+			newFieldsMerge := func(name string, hosts, gateways []string) *VirtualServiceMerge {
+				merge := newTestMerge(name)
+				merge.UID = types.UID(uid + "-" + name)
+				merge.Spec.MergeFields = []MergeField{MergeFieldHosts, MergeFieldGateways}
+				merge.Spec.Patch.Hosts = hosts
+				merge.Spec.Patch.Gateways = gateways
+				return merge
+			}
+			target := &alpha3.VirtualService{}
+			target.Spec.Hosts = []string{"base.example.com"}
+			target.Spec.Gateways = []string{"istio-system/base"}
+			ledger := OwnershipLedger{}
+			m1 := newFieldsMerge("m1", []string{"a.example.com", "shared.example.com", "base.example.com"}, []string{"istio-system/shared"})
+			m2 := newFieldsMerge("m2", []string{"shared.example.com"}, []string{"istio-system/shared", "istio-system/m2"})
+
+			m1.AddListFields(target, ledger)
+			m2.AddListFields(target, ledger)
+			assertStrings(t, target.Spec.Hosts, "base.example.com", "a.example.com", "shared.example.com")
+			assertStrings(t, target.Spec.Gateways, "istio-system/base", "istio-system/shared", "istio-system/m2")
+			// the values already in the target are left unmanaged
+			assertStrings(t, m1.Status.Hosts, "a.example.com", "shared.example.com")
+			assertStrings(t, m2.Status.Hosts, "shared.example.com")
+			assertStrings(t, m2.Status.Gateways, "istio-system/shared", "istio-system/m2")
+
+			// a value added by two merges survives the deletion of one
+			m1.RemoveListFields(target, ledger)
+			assertStrings(t, target.Spec.Hosts, "base.example.com", "shared.example.com")
+			assertStrings(t, target.Spec.Gateways, "istio-system/base", "istio-system/shared", "istio-system/m2")
+
+			// a value no merge contributes anymore is removed
+			m2.Spec.Patch.Gateways = []string{"istio-system/m2"}
+			m2.AddListFields(target, ledger)
+			assertStrings(t, target.Spec.Gateways, "istio-system/base", "istio-system/m2")
+
+			m2.RemoveListFields(target, ledger)
+			assertStrings(t, target.Spec.Hosts, "base.example.com")
+			assertStrings(t, target.Spec.Gateways, "istio-system/base")
+			if len(ledger) != 0 {
+				t.Errorf("ledger = %v, want it empty", ledger)
+			}
+		})
+	}
+}
+
+func TestListFieldsOptOut(t *testing.T) {
+	merge := newTestMerge("m")
+	merge.Spec.MergeFields = []MergeField{MergeFieldExportTo}
+	merge.Spec.Patch.ExportTo = []string{"."}
+	target := &alpha3.VirtualService{}
+	ledger := OwnershipLedger{}
+	merge.AddListFields(target, ledger)
+	assertStrings(t, target.Spec.ExportTo, ".")
+
+	// the contributions are released when the field is not merged anymore
+	merge.Spec.MergeFields = nil
+	merge.AddListFields(target, ledger)
+	assertStrings(t, target.Spec.ExportTo)
+	assertStrings(t, merge.Status.ExportTo)
+}
+
+func TestFieldValue(t *testing.T) {
+	owner := RouteOwner{UID: "default/m"}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{fieldLedgerKey(MergeFieldGateways, "istio-system/gw", owner.UID), "istio-system/gw"},
+		{fieldLedgerKey(MergeFieldHosts, "a.example.com", owner.UID), ""},
+		{fieldLedgerKey(MergeFieldGateways, "gw", "other"), ""},
+		{"gateways/default/m", ""},
+		{httpLedgerKey("gateways/gw/default/m"), ""},
+	}
+	for _, tt := range tests {
+		if got := fieldValue(tt.key, owner, MergeFieldGateways); got != tt.want {
+			t.Errorf("fieldValue(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -32,4 +32,26 @@ type VirtualServiceMergeSpec struct {
 	Target Target `json:"target"`
 	// +kubebuilder:validation:Required
 	Patch networkingv1alpha3.VirtualService `json:"patch"`
+	// TcpRouteKeys optionally gives the tcp routes of the patch, by position, an explicit
+	// identity. A keyed route keeps replacing the route it previously wrote to the target
+	// even when its match attributes change.
+	// +optional
+	TcpRouteKeys []string `json:"tcpRouteKeys,omitempty"`
+	// MergeFields opts the hosts, gateways and exportTo lists of the patch into the merge.
+	// Their values are added to the target lists and removed once no merge contributes them.
+	// +optional
+	MergeFields []MergeField `json:"mergeFields,omitempty"`
+	// Priority orders the http routes of the patch among the routes of the target, the
+	// highest first. Routes without one are ordered by the precedence suffix of their
+	// name, e.g. "reviews-2", or have a priority of 0 when their name has no such suffix.
+	// +optional
+	Priority *int32 `json:"priority,omitempty"`
+	// RoutePriorities overrides the priority of the named http routes of the patch
+	// +optional
+	RoutePriorities map[string]int32 `json:"routePriorities,omitempty"`
+	// DryRun renders the target with the patch applied into the status instead of writing it.
+	// Incrementally merged targets keep the routes the merge previously contributed,
+	// fully rendered ones leave the merge out.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
 }
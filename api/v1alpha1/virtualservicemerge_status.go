@@ -16,8 +16,114 @@
 
 package v1alpha1
 
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ConditionReady is true when the merge is fully applied to its target
+	ConditionReady = "Ready"
+	// ConditionTargetFound is true when the target VirtualService exists
+	ConditionTargetFound = "TargetFound"
+	// ConditionApplied is true when the patch has been written to the target
+	ConditionApplied = "Applied"
+	// ConditionConflicted is true when the patch routes collide with routes of another merge
+	ConditionConflicted = "Conflicted"
+	// ConditionShadowed is true when some patch routes can never be reached in the target
+	ConditionShadowed = "Shadowed"
+)
+
+const (
+	ReasonApplied         = "Applied"
+	ReasonRemoved         = "Removed"
+	ReasonDryRun          = "DryRun"
+	ReasonDrifted         = "Drifted"
+	ReasonTargetUpdated   = "Updated"
+	ReasonTargetChanged   = "TargetChanged"
+	ReasonTargetCreated   = "TargetCreated"
+	ReasonTargetDeleted   = "TargetDeleted"
+	ReasonTargetFound     = "TargetFound"
+	ReasonTargetNotFound  = "TargetNotFound"
+	ReasonNoTargetMatched = "NoTargetMatched"
+	ReasonAmbiguousTarget = "AmbiguousTarget"
+	ReasonUpdateFailed    = "UpdateFailed"
+	ReasonRouteConflict   = "RouteConflict"
+	ReasonNoRouteConflict = "NoRouteConflict"
+	ReasonRouteShadowed   = "RouteShadowed"
+	ReasonNoRouteShadowed = "NoRouteShadowed"
+)
+
 // VirtualServicePatchStatus defines the observed state of VirtualServiceMerge
 type VirtualServicePatchStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	HandledRevision string `json:"HandledRevision,omitempty"`
+	// ObservedGeneration is the last generation of the merge handled by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Target is the VirtualService the merge was resolved to
+	Target *TargetReference `json:"target,omitempty"`
+	// Targets are the VirtualServices a merge with a target selector is applied to
+	Targets []TargetReference `json:"targets,omitempty"`
+	// HttpRoutes are the names of the http routes the merge contributed to the target
+	HttpRoutes []string `json:"httpRoutes,omitempty"`
+	// TcpRoutes are the tcp routes the merge contributed to the target
+	TcpRoutes []RouteRef `json:"tcpRoutes,omitempty"`
+	// TlsRoutes are the tls routes the merge contributed to the target
+	TlsRoutes []RouteRef `json:"tlsRoutes,omitempty"`
+	// Hosts are the hosts the merge contributed to the target
+	Hosts []string `json:"hosts,omitempty"`
+	// Gateways are the gateways the merge contributed to the target
+	Gateways []string `json:"gateways,omitempty"`
+	// ExportTo are the namespaces the merge contributed to the exportTo of the target
+	ExportTo []string `json:"exportTo,omitempty"`
+	// DryRun is the result of the last dry run of the merge
+	DryRun *DryRunResult `json:"dryRun,omitempty"`
+	// LastAppliedTime is the last time the merge was applied to the target
+	LastAppliedTime metav1.Time `json:"lastAppliedTime,omitempty"`
+	// LastError is the error of the last failed reconciliation
+	LastError string `json:"lastError,omitempty"`
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// TargetReference identifies a resolved target VirtualService
+type TargetReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+func (in TargetReference) String() string {
+	return in.Namespace + "/" + in.Name
+}
+
+// RouteRef identifies a route without a name that a merge wrote to its target
+type RouteRef struct {
+	// Key is the explicit key of the route or its Match when none is given
+	Key string `json:"key"`
+	// Match is the identity computed from the match attributes of the route
+	Match string `json:"match"`
+}
+
+// DryRunResult is the target VirtualService a merge in dry run would produce
+type DryRunResult struct {
+	// Generation is the generation of the merge which was rendered
+	Generation int64 `json:"generation"`
+	// TargetRevision is the resourceVersion of the target the merge was rendered onto
+	TargetRevision string `json:"targetRevision,omitempty"`
+	// Rendered is the spec of the target with the merge applied, in YAML
+	Rendered string `json:"rendered"`
+	// Diff summarizes the changes the merge would make to the target
+	Diff string `json:"diff,omitempty"`
+}
+
+// SetCondition adds or updates the condition of the given type, stamped with the merge generation
+func (in *VirtualServiceMerge) SetCondition(conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&in.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: in.Generation,
+	})
 }
@@ -18,8 +18,7 @@ package v1alpha1
 
 import (
 	"fmt"
-	"github.com/monimesl/operator-helper/reconciler"
-	"go.uber.org/zap"
+	"github.com/go-logr/logr"
 	"istio.io/api/networking/v1alpha3"
 	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -43,6 +42,10 @@ func init() {
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.status.target.name`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 type VirtualServiceMerge struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -52,138 +55,249 @@ type VirtualServiceMerge struct {
 	Status VirtualServicePatchStatus `json:"status,omitempty"`
 }
 
-func (in *VirtualServiceMerge) AddTcpRoutes(target *alpha3.VirtualService) {
+// AddTcpRoutes merges the patch tcp routes into the target and returns the
+// routes left untouched because they belong to someone else.
+func (in *VirtualServiceMerge) AddTcpRoutes(target *alpha3.VirtualService, ledger OwnershipLedger) []string {
 	targetRoutes := target.Spec.Tcp
+	stale := in.ownedKeys(ledger, tcpKind)
+	refs := in.TcpRouteRefs()
+	applied := make([]RouteRef, 0, len(refs))
+	protected := make([]string, 0)
 outer:
-	for _, pRoute := range in.Spec.Patch.Tcp {
-		for i, tRoute := range targetRoutes {
-			if tcpMatchesEqual(tRoute.Match, pRoute.Match) {
-				targetRoutes[i] = pRoute // replace
+	for i, pRoute := range in.Spec.Patch.Tcp {
+		key := tcpLedgerKey(refs[i].Match)
+		// a keyed route replaces the route it previously wrote even if its match changed
+		previous := refs[i].Match
+		if ref, ok := findRouteRef(in.Status.TcpRoutes, refs[i].Key); ok {
+			previous = ref.Match
+		}
+		for j, tRoute := range targetRoutes {
+			match := tcpMatchKey(tRoute.Match)
+			if match != previous && match != refs[i].Match {
+				continue
+			}
+			if !in.owns(ledger, tcpLedgerKey(match)) {
+				protected = append(protected, ledger.describe(tcpLedgerKey(match)))
 				continue outer
 			}
+			delete(ledger, tcpLedgerKey(match))
+			targetRoutes[j] = pRoute // replace
+			ledger.claim(key, in)
+			delete(stale, key)
+			applied = append(applied, refs[i])
+			continue outer
 		}
 		// add
 		targetRoutes = append(targetRoutes, pRoute)
+		ledger.claim(key, in)
+		delete(stale, key)
+		applied = append(applied, refs[i])
 	}
-	target.Spec.Tcp = targetRoutes
+	// drop the routes this patch added before but no longer contains
+	target.Spec.Tcp = removeTcpRoutes(targetRoutes, stale)
+	ledger.release(stale)
+	in.Status.TcpRoutes = applied
+	return protected
 }
 
-func (in *VirtualServiceMerge) RemoveTcpRoutes(target *alpha3.VirtualService) {
-	targetRoutes := target.Spec.Tcp
-outer:
-	for _, pRoute := range in.Spec.Patch.Tcp {
-		for i, tRoute := range targetRoutes {
-			if tcpMatchesEqual(tRoute.Match, pRoute.Match) {
-				// remove the route
-				targetRoutes = append(targetRoutes[0:i], targetRoutes[i+1:]...)
-				continue outer
-			}
+// RemoveTcpRoutes removes from the target the tcp routes the merge owns
+func (in *VirtualServiceMerge) RemoveTcpRoutes(target *alpha3.VirtualService, ledger OwnershipLedger) {
+	owned := in.ownedKeys(ledger, tcpKind)
+	target.Spec.Tcp = removeTcpRoutes(target.Spec.Tcp, owned)
+	ledger.release(owned)
+	in.Status.TcpRoutes = nil
+}
+
+// TcpRouteRefs returns the identities of the patch tcp routes
+func (in *VirtualServiceMerge) TcpRouteRefs() []RouteRef {
+	refs := make([]RouteRef, len(in.Spec.Patch.Tcp))
+	for i, r := range in.Spec.Patch.Tcp {
+		match := tcpMatchKey(r.Match)
+		refs[i] = RouteRef{Key: match, Match: match}
+		if i < len(in.Spec.TcpRouteKeys) && in.Spec.TcpRouteKeys[i] != "" {
+			refs[i].Key = in.Spec.TcpRouteKeys[i]
 		}
 	}
-	target.Spec.Tcp = targetRoutes
+	return refs
 }
 
-func tcpMatchesEqual(sourceMatches []*v1alpha3.L4MatchAttributes, match2 []*v1alpha3.L4MatchAttributes) bool {
-	for _, sM := range sourceMatches {
-		for _, cM := range match2 {
-			if sM.Port == cM.Port {
-				// we treat port equality as equal
-				return true
-			}
+func removeTcpRoutes(routes []*v1alpha3.TCPRoute, keys map[string]bool) []*v1alpha3.TCPRoute {
+	kept := make([]*v1alpha3.TCPRoute, 0, len(routes))
+	for _, r := range routes {
+		if !keys[tcpLedgerKey(tcpMatchKey(r.Match))] {
+			kept = append(kept, r)
 		}
 	}
-	return false
+	return kept
 }
 
-func (in *VirtualServiceMerge) AddTlsRoutes(target *alpha3.VirtualService) {
+// AddTlsRoutes merges the patch tls routes into the target and returns the
+// routes left untouched because they belong to someone else.
+func (in *VirtualServiceMerge) AddTlsRoutes(target *alpha3.VirtualService, ledger OwnershipLedger) []string {
 	targetRoutes := target.Spec.Tls
+	stale := in.ownedKeys(ledger, tlsKind)
+	refs := in.TlsRouteRefs()
+	applied := make([]RouteRef, 0, len(refs))
+	protected := make([]string, 0)
 outer:
-	for _, pRoute := range in.Spec.Patch.Tls {
-		for i, tRoute := range targetRoutes {
-			if tlsMatchesEqual(tRoute.Match, pRoute.Match) {
-				targetRoutes[i] = pRoute // replace
+	for i, pRoute := range in.Spec.Patch.Tls {
+		key := tlsLedgerKey(refs[i].Match)
+		for j, tRoute := range targetRoutes {
+			if tlsMatchKey(tRoute.Match) != refs[i].Match {
+				continue
+			}
+			if !in.owns(ledger, key) {
+				protected = append(protected, ledger.describe(key))
 				continue outer
 			}
+			targetRoutes[j] = pRoute // replace
+			ledger.claim(key, in)
+			delete(stale, key)
+			applied = append(applied, refs[i])
+			continue outer
 		}
 		// add
 		targetRoutes = append(targetRoutes, pRoute)
+		ledger.claim(key, in)
+		delete(stale, key)
+		applied = append(applied, refs[i])
 	}
-	target.Spec.Tls = targetRoutes
+	// drop the routes this patch added before but no longer contains
+	target.Spec.Tls = removeTlsRoutes(targetRoutes, stale)
+	ledger.release(stale)
+	in.Status.TlsRoutes = applied
+	return protected
 }
 
-func (in *VirtualServiceMerge) RemoveTlsRoutes(target *alpha3.VirtualService) {
-	targetRoutes := target.Spec.Tls
-outer:
-	for _, pRoute := range in.Spec.Patch.Tls {
-		for i, tRoute := range targetRoutes {
-			if tlsMatchesEqual(tRoute.Match, pRoute.Match) {
-				// remove the route
-				targetRoutes = append(targetRoutes[0:i], targetRoutes[i+1:]...)
-				continue outer
-			}
-		}
+// RemoveTlsRoutes removes from the target the tls routes the merge owns
+func (in *VirtualServiceMerge) RemoveTlsRoutes(target *alpha3.VirtualService, ledger OwnershipLedger) {
+	owned := in.ownedKeys(ledger, tlsKind)
+	target.Spec.Tls = removeTlsRoutes(target.Spec.Tls, owned)
+	ledger.release(owned)
+	in.Status.TlsRoutes = nil
+}
+
+// TlsRouteRefs returns the identities of the patch tls routes
+func (in *VirtualServiceMerge) TlsRouteRefs() []RouteRef {
+	refs := make([]RouteRef, len(in.Spec.Patch.Tls))
+	for i, r := range in.Spec.Patch.Tls {
+		match := tlsMatchKey(r.Match)
+		refs[i] = RouteRef{Key: match, Match: match}
 	}
-	target.Spec.Tls = targetRoutes
+	return refs
 }
 
-func tlsMatchesEqual(sourceMatches []*v1alpha3.TLSMatchAttributes, match2 []*v1alpha3.TLSMatchAttributes) bool {
-	for _, sM := range sourceMatches {
-		for _, cM := range match2 {
-			if sM.Port == cM.Port {
-				// we treat port equality as equal
-				return true
-			}
+func removeTlsRoutes(routes []*v1alpha3.TLSRoute, keys map[string]bool) []*v1alpha3.TLSRoute {
+	kept := make([]*v1alpha3.TLSRoute, 0, len(routes))
+	for _, r := range routes {
+		if !keys[tlsLedgerKey(tlsMatchKey(r.Match))] {
+			kept = append(kept, r)
 		}
 	}
-	return false
+	return kept
 }
 
-func (in *VirtualServiceMerge) AddHttpRoutes(ctx reconciler.Context, target *alpha3.VirtualService) {
+// AddHttpRoutes merges the patch http routes into the target and returns the
+// routes left untouched because they belong to someone else.
+func (in *VirtualServiceMerge) AddHttpRoutes(log logr.Logger, target *alpha3.VirtualService, ledger OwnershipLedger) []string {
 	targetRoutes := target.Spec.Http
-	patchRoutes := in.generateHttpRoutes(ctx)
+	stale := in.ownedKeys(ledger, httpKind)
+	patchRoutes := in.generateHttpRoutes(log)
+	applied := make([]string, 0, len(patchRoutes))
+	added := make([]*v1alpha3.HTTPRoute, 0)
+	protected := make([]string, 0)
 outer:
 	for _, pRoute := range patchRoutes {
+		key := httpLedgerKey(pRoute.Name)
 		for i, tRoute := range targetRoutes {
-			if tRoute.Name == pRoute.Name {
-				targetRoutes[i] = pRoute // replace
+			if tRoute.Name != pRoute.Name {
+				continue
+			}
+			if !in.owns(ledger, key) {
+				protected = append(protected, ledger.describe(key))
 				continue outer
 			}
+			targetRoutes[i] = pRoute // replace
+			ledger.claimRoute(key, in, in.routePriority(pRoute.Name))
+			delete(stale, key)
+			applied = append(applied, pRoute.Name)
+			continue outer
 		}
-		// add - prepend to the slice just so that the new route is above
-		// the "default", i.e. no a matchspec route already in the targeted vs.
-		targetRoutes = append(targetRoutes, pRoute)
-		copy(targetRoutes[1:], targetRoutes)
-		targetRoutes[0] = pRoute
+		added = append(added, pRoute)
+		ledger.claimRoute(key, in, in.routePriority(pRoute.Name))
+		delete(stale, key)
+		applied = append(applied, pRoute.Name)
 	}
-	target.Spec.Http = sanitizeRoutes(ctx, targetRoutes)
+	// add - prepend to the slice just so that the new routes are above
+	// the "default", i.e. no a matchspec route already in the targeted vs.
+	targetRoutes = append(added, targetRoutes...)
+	// drop the routes this patch added before but no longer contains
+	target.Spec.Http = sanitizeRoutes(log, removeHttpRoutes(targetRoutes, stale), ledger, RouteOrdering(target))
+	ledger.release(stale)
+	in.Status.HttpRoutes = applied
+	return protected
 }
 
-func (in *VirtualServiceMerge) RemoveHttpRoutes(ctx reconciler.Context, target *alpha3.VirtualService) {
-	targetRoutes := target.Spec.Http
-	patchRoutes := in.generateHttpRoutes(ctx)
-outer:
-	for _, pRoute := range patchRoutes {
-		for i, tRoute := range targetRoutes {
-			if tRoute.Name == pRoute.Name {
-				// remove the route
-				targetRoutes = append(targetRoutes[0:i], targetRoutes[i+1:]...)
-				continue outer
-			}
+// RemoveHttpRoutes removes from the target the http routes the merge owns
+func (in *VirtualServiceMerge) RemoveHttpRoutes(log logr.Logger, target *alpha3.VirtualService, ledger OwnershipLedger) {
+	owned := in.ownedKeys(ledger, httpKind)
+	target.Spec.Http = sanitizeRoutes(log, removeHttpRoutes(target.Spec.Http, owned), ledger, RouteOrdering(target))
+	ledger.release(owned)
+	in.Status.HttpRoutes = nil
+}
+
+func removeHttpRoutes(routes []*v1alpha3.HTTPRoute, keys map[string]bool) []*v1alpha3.HTTPRoute {
+	kept := make([]*v1alpha3.HTTPRoute, 0, len(routes))
+	for _, r := range routes {
+		if !keys[httpLedgerKey(r.Name)] {
+			kept = append(kept, r)
 		}
 	}
-	target.Spec.Http = sanitizeRoutes(ctx, targetRoutes)
+	return kept
 }
 
-func sanitizeRoutes(ctx reconciler.Context, routes []*v1alpha3.HTTPRoute) []*v1alpha3.HTTPRoute {
+// sanitizeRoutes orders the routes by decreasing priority. The priority of a merged route
+// is the one recorded in the ledger, the precedence suffix of its name otherwise.
+// With OrderBySpecificity, the routes are ordered by decreasing specificity first
+// and the catch-all routes not merged by any merge are kept last.
+func sanitizeRoutes(log logr.Logger, routes []*v1alpha3.HTTPRoute, ledger OwnershipLedger, ordering string) []*v1alpha3.HTTPRoute {
+	priorities := make(map[*v1alpha3.HTTPRoute]int, len(routes))
+	specificities := make(map[*v1alpha3.HTTPRoute]specificity, len(routes))
+	baseCatchAll := make(map[*v1alpha3.HTTPRoute]bool, len(routes))
+	for _, r := range routes {
+		owner, owned := ledger[httpLedgerKey(r.Name)]
+		if owned && owner.Priority != nil {
+			priorities[r] = int(*owner.Priority)
+		} else {
+			_, priorities[r], _ = parsePrecedence(log, r.Name)
+		}
+		specificities[r] = routeSpecificity(r)
+		baseCatchAll[r] = !owned && specificities[r].catchAll()
+	}
 	sort.SliceStable(routes, func(i, j int) bool {
-		_, iPrecedence, _ := parsePrecedence(ctx, routes[i].Name)
-		_, jPrecedence, _ := parsePrecedence(ctx, routes[j].Name)
-		return iPrecedence > jPrecedence
+		ri, rj := routes[i], routes[j]
+		if ordering == OrderBySpecificity {
+			if baseCatchAll[ri] != baseCatchAll[rj] {
+				return baseCatchAll[rj]
+			}
+			if specificities[ri] != specificities[rj] {
+				return specificities[rj].less(specificities[ri])
+			}
+		}
+		return priorities[ri] > priorities[rj]
 	})
 	return routes
 }
 
-func parsePrecedence(ctx reconciler.Context, name string) (string, int, bool) {
+// routePriority returns the explicit priority of the patch route with the given name, if any
+func (in *VirtualServiceMerge) routePriority(name string) *int32 {
+	if priority, ok := in.Spec.RoutePriorities[name]; ok {
+		return &priority
+	}
+	return in.Spec.Priority
+}
+
+func parsePrecedence(log logr.Logger, name string) (string, int, bool) {
 	parts := strings.Split(name, "-")
 	if len(parts) <= 1 {
 		return name, 0, false
@@ -191,13 +305,13 @@ func parsePrecedence(ctx reconciler.Context, name string) (string, int, bool) {
 	precedenceStr := parts[len(parts)-1]
 	precedence, err := strconv.ParseInt(precedenceStr, 10, 64)
 	if err != nil {
-		ctx.Logger().Info("No precedence for route. Defaulting to 0", "route", name)
+		log.V(1).Info("No precedence suffix in the route name, defaulting to 0", "route", name)
 		return name, 0, false
 	}
 	return strings.Join(parts[:len(parts)-1], "-"), int(precedence), true
 }
 
-func (in *VirtualServiceMerge) generateHttpRoutes(ctx reconciler.Context) []*v1alpha3.HTTPRoute {
+func (in *VirtualServiceMerge) generateHttpRoutes(log logr.Logger) []*v1alpha3.HTTPRoute {
 	routes := make([]*v1alpha3.HTTPRoute, len(in.Spec.Patch.Http))
 	routesCount := len(in.Spec.Patch.Http)
 	for i, r := range in.Spec.Patch.Http {
@@ -206,13 +320,11 @@ func (in *VirtualServiceMerge) generateHttpRoutes(ctx reconciler.Context) []*v1a
 			// make the precedence decrease as we go down the list.
 			precedence := int64(routesCount - i - 1)
 			r.Name = fmt.Sprintf("%s-%d", in.Name, precedence)
-		} else if _, _, ok := parsePrecedence(ctx, r.Name); !ok {
-			// make the precedence decrease as we go down the list.
-			precedence := int64(routesCount - i - 1)
-			r.Name = fmt.Sprintf("%s-%d", in.Name, precedence)
 		}
 		routes[i] = r
-		zap.S().Info("The patch '%s' route '%s' rewritten to '%s'", in.Name, name, r.Name)
+		if r.Name != name {
+			log.V(1).Info("Route renamed", "merge", in.Namespace+"/"+in.Name, "route", name, "renamedTo", r.Name)
+		}
 	}
 	return routes
 }
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		base       string
+		precedence int
+		ok         bool
+	}{
+		{"reviews-2", "reviews", 2, true},
+		{"reviews-v2-10", "reviews-v2", 10, true},
+		{"api-v2", "api-v2", 0, false},
+		{"api", "api", 0, false},
+		{"api-", "api-", 0, false},
+	}
+	for _, tt := range tests {
+		base, precedence, ok := parsePrecedence(logr.Discard(), tt.name)
+		if base != tt.base || precedence != tt.precedence || ok != tt.ok {
+			t.Errorf("parsePrecedence(%q) = %q, %d, %v, want %q, %d, %v", tt.name, base, precedence, ok, tt.base, tt.precedence, tt.ok)
+		}
+	}
+}
+
+func TestGenerateHttpRoutes(t *testing.T) {
+	merge := newTestMerge("m")
+	merge.Spec.Patch.Http = []*v1alpha3.HTTPRoute{
+		httpRoute("", "a"),
+		httpRoute("api-v2", "b"),
+		httpRoute("reviews-2", "c"),
+		httpRoute("", "d"),
+	}
+	names := make([]string, 0)
+	for _, r := range merge.generateHttpRoutes(logr.Discard()) {
+		names = append(names, r.Name)
+	}
+	// only the unnamed routes are named, with a precedence decreasing down the list
+	assertStrings(t, names, "m-3", "api-v2", "reviews-2", "m-0")
+}
+
+func TestHttpRoutesPriority(t *testing.T) {
+	priority := int32(1)
+	tests := []struct {
+		name       string
+		routes     []string
+		priority   *int32
+		priorities map[string]int32
+		want       []string
+	}{
+		{
+			name:   "names without a suffix have a priority of 0",
+			routes: []string{"api-v2", "api"},
+			want:   []string{"high-5", "api-v2", "api", "default", "low-0"},
+		},
+		{
+			name:   "names with a suffix are ordered by it",
+			routes: []string{"api-3", "api-v2-1"},
+			want:   []string{"high-5", "api-3", "api-v2-1", "default", "low-0"},
+		},
+		{
+			name:     "the priority overrides the suffix",
+			routes:   []string{"api-v2", "api-9"},
+			priority: &priority,
+			want:     []string{"high-5", "api-v2", "api-9", "default", "low-0"},
+		},
+		{
+			name:       "the route priorities override the priority",
+			routes:     []string{"api-v2", "api-0", "api-9"},
+			priority:   &priority,
+			priorities: map[string]int32{"api-v2": 10, "api-0": 3},
+			want:       []string{"api-v2", "high-5", "api-0", "api-9", "default", "low-0"},
+		},
+		{
+			name:       "the route priorities apply to names without a suffix",
+			routes:     []string{"api-v2", "api"},
+			priorities: map[string]int32{"api": -1},
+			want:       []string{"high-5", "api-v2", "default", "low-0", "api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &alpha3.VirtualService{}
+			target.Spec.Http = []*v1alpha3.HTTPRoute{httpRoute("high-5", "base"), httpRoute("default", "base"), httpRoute("low-0", "base")}
+			merge := newTestMerge("m")
+			merge.Spec.Priority = tt.priority
+			merge.Spec.RoutePriorities = tt.priorities
+			for _, name := range tt.routes {
+				merge.Spec.Patch.Http = append(merge.Spec.Patch.Http, httpRoute(name, "patch"))
+			}
+			ledger := OwnershipLedger{}
+			merge.AddHttpRoutes(logr.Discard(), target, ledger)
+			assertStrings(t, routeNames(target.Spec.Http), tt.want...)
+
+			// the priorities are recorded so that the order holds when another merge is applied
+			other := newTestMerge("other")
+			other.Spec.Patch.Http = []*v1alpha3.HTTPRoute{httpRoute("other-0", "other")}
+			other.AddHttpRoutes(logr.Discard(), target, ledger)
+			other.RemoveHttpRoutes(logr.Discard(), target, ledger)
+			assertStrings(t, routeNames(target.Spec.Http), tt.want...)
+		})
+	}
+}
+
+func TestLegacyGeneratedNames(t *testing.T) {
+	// legacyMerge returns a merge last handled by a release renaming the routes without a
+	// precedence suffix after the merge, along with the target as it wrote it
+	legacyMerge := func(name string) (*VirtualServiceMerge, []*v1alpha3.HTTPRoute) {
+		merge := newTestMerge(name)
+		merge.Status.HandledRevision = "1"
+		merge.Spec.Patch.Http = []*v1alpha3.HTTPRoute{httpRoute("api", name+"-v2"), httpRoute("web-1", name+"-v2")}
+		return merge, []*v1alpha3.HTTPRoute{httpRoute(name+"-1", name+"-v1"), httpRoute("web-1", name+"-v1")}
+	}
+
+	t.Run("replaces the generated names by the route names", func(t *testing.T) {
+		merge, routes := legacyMerge("m")
+		target := &alpha3.VirtualService{}
+		target.Spec.Http = append(routes, httpRoute("default", "base"))
+		ledger := OwnershipLedger{}
+		assertStrings(t, merge.AddHttpRoutes(logr.Discard(), target, ledger))
+		assertStrings(t, httpDestinations(target.Spec.Http), "web-1:m-v2", "api:m-v2", "default:base")
+		assertStrings(t, ledgerKeys(ledger), "http/api", "http/web-1")
+	})
+
+	t.Run("removes the generated names of the merge conflicting with another merge", func(t *testing.T) {
+		m, mRoutes := legacyMerge("m")
+		n, nRoutes := legacyMerge("n")
+		target := &alpha3.VirtualService{}
+		target.Spec.Http = append(append(mRoutes, nRoutes[0]), httpRoute("default", "base"))
+		ledger := OwnershipLedger{}
+		m.AddHttpRoutes(logr.Discard(), target, ledger)
+		// the route names are shared by the merges of the target, the first one applied owns it
+		assertStrings(t, n.AddHttpRoutes(logr.Discard(), target, ledger),
+			"http/api (owned by default/m)", "http/web-1 (owned by default/m)")
+		assertStrings(t, httpDestinations(target.Spec.Http), "web-1:m-v2", "api:m-v2", "default:base")
+		assertStrings(t, ledgerKeys(ledger), "http/api", "http/web-1")
+	})
+}
+
+func ledgerKeys(ledger OwnershipLedger) []string {
+	keys := make([]string, 0, len(ledger))
+	for key := range ledger {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/monimesl/operator-helper/reconciler"
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/validate-istiomerger-monime-sl-v1alpha1-virtualservicemerge,mutating=false,failurePolicy=fail,sideEffects=None,groups=istiomerger.monime.sl,resources=virtualservicemerges,verbs=create;update,versions=v1alpha1,name=vvirtualservicemerge.kb.io,admissionReviewVersions=v1
+
+var _ admission.Validator = &VirtualServiceMerge{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (in *VirtualServiceMerge) ValidateCreate() (admission.Warnings, error) {
+	return nil, in.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (in *VirtualServiceMerge) ValidateUpdate(_ runtime.Object) (admission.Warnings, error) {
+	return nil, in.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (in *VirtualServiceMerge) ValidateDelete() (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (in *VirtualServiceMerge) validate() error {
+	if !in.DeletionTimestamp.IsZero() {
+		// let the finalizer be removed whatever the spec
+		return nil
+	}
+	errs := field.ErrorList{}
+	for _, validate := range []func(*field.ErrorList){
+		in.validateTarget,
+		in.validateHttpRoutes,
+		in.validateTcpRoutes,
+		in.validateTlsRoutes,
+	} {
+		validate(&errs)
+	}
+	// the patch and the routes of the other merges are checked against the cluster
+	ctx := reconciler.GetContext()
+	in.validatePatch(ctx, &errs)
+	in.validateCollisions(ctx, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("VirtualServiceMerge").GroupKind(), in.Name, errs)
+}
+
+func (in *VirtualServiceMerge) validateTarget(errs *field.ErrorList) {
+	path := field.NewPath("spec", "target")
+	if err := in.Spec.Target.Validate(); err != nil {
+		*errs = append(*errs, targetError(path, &in.Spec.Target, in.Namespace, err))
+		return
+	}
+	if !in.Spec.Target.IsSelector() {
+		return
+	}
+	if _, _, err := in.Spec.Target.Selectors(); err != nil {
+		*errs = append(*errs, field.Invalid(path.Child("selector"), in.Spec.Target.String(in.Namespace), err.Error()))
+	}
+	if in.Spec.DryRun {
+		*errs = append(*errs, field.Forbidden(field.NewPath("spec", "dryRun"), "a dry run needs a target name"))
+	}
+}
+
+// targetError reports the error of an invalid target against the field at fault
+func targetError(path *field.Path, target *Target, namespace string, err error) *field.Error {
+	switch err {
+	case errEmptyTargetName:
+		return field.Required(path.Child("name"), err.Error())
+	case errGatewayWithoutHost:
+		return field.Invalid(path.Child("gateway"), target.Gateway, err.Error())
+	case errCreateWithoutName:
+		return field.Invalid(path.Child("createIfMissing"), target.CreateIfMissing, err.Error())
+	case errCreateWithoutTemplate:
+		return field.Required(path.Child("template", "hosts"), err.Error())
+	case errSelectorWithoutSelection:
+		return field.Invalid(path.Child("selector"), metav1.FormatLabelSelector(target.Selector), err.Error())
+	case errNamespaceSelector:
+		return field.Invalid(path.Child("namespaceSelector"), metav1.FormatLabelSelector(target.NamespaceSelector), err.Error())
+	case errNamespaceAndSelector:
+		return field.Invalid(path.Child("namespace"), target.Namespace, err.Error())
+	}
+	return field.Invalid(path, target.String(namespace), err.Error())
+}
+
+// validateHttpRoutes checks the http routes of the patch for what a merge needs on top of
+// Istio's own validation, see validatePatch
+func (in *VirtualServiceMerge) validateHttpRoutes(errs *field.ErrorList) {
+	names := map[string]bool{}
+	for i, route := range in.Spec.Patch.Http {
+		path := field.NewPath("spec", "patch", "http").Index(i)
+		if route.Name != "" {
+			if names[route.Name] {
+				*errs = append(*errs, field.Duplicate(path.Child("name"), route.Name))
+			}
+			names[route.Name] = true
+			if in.routePriority(route.Name) == nil {
+				if err := validatePrecedence(route.Name); err != nil {
+					*errs = append(*errs, field.Invalid(path.Child("name"), route.Name, err.Error()))
+				}
+			}
+		}
+		if len(route.Route) == 0 && route.Redirect == nil && route.DirectResponse == nil && route.Delegate == nil {
+			*errs = append(*errs, field.Required(path.Child("route"), "a route, redirect, directResponse or delegate is required"))
+		}
+		for j, destination := range route.Route {
+			validateDestination(errs, path.Child("route").Index(j), destination.GetDestination())
+		}
+	}
+	for name := range in.Spec.RoutePriorities {
+		if !names[name] {
+			*errs = append(*errs, field.NotFound(field.NewPath("spec", "routePriorities").Key(name), name))
+		}
+	}
+}
+
+func (in *VirtualServiceMerge) validateTcpRoutes(errs *field.ErrorList) {
+	for i, route := range in.Spec.Patch.Tcp {
+		path := field.NewPath("spec", "patch", "tcp").Index(i)
+		if len(route.Match) == 0 {
+			*errs = append(*errs, field.Required(path.Child("match"), "a tcp route merged into a shared target must have a match"))
+		}
+		if len(route.Route) == 0 {
+			*errs = append(*errs, field.Required(path.Child("route"), "at least one destination is required"))
+		}
+		for j, destination := range route.Route {
+			validateDestination(errs, path.Child("route").Index(j), destination.GetDestination())
+		}
+	}
+	if len(in.Spec.TcpRouteKeys) > len(in.Spec.Patch.Tcp) {
+		*errs = append(*errs, field.TooMany(field.NewPath("spec", "tcpRouteKeys"), len(in.Spec.TcpRouteKeys), len(in.Spec.Patch.Tcp)))
+	}
+}
+
+func (in *VirtualServiceMerge) validateTlsRoutes(errs *field.ErrorList) {
+	for i, route := range in.Spec.Patch.Tls {
+		path := field.NewPath("spec", "patch", "tls").Index(i)
+		if len(route.Match) == 0 {
+			*errs = append(*errs, field.Required(path.Child("match"), "at least one match is required"))
+		}
+		for j, match := range route.Match {
+			if len(match.SniHosts) == 0 {
+				*errs = append(*errs, field.Required(path.Child("match").Index(j).Child("sniHosts"), "at least one SNI host is required"))
+			}
+		}
+		if len(route.Route) == 0 {
+			*errs = append(*errs, field.Required(path.Child("route"), "at least one destination is required"))
+		}
+		for j, destination := range route.Route {
+			validateDestination(errs, path.Child("route").Index(j), destination.GetDestination())
+		}
+	}
+}
+
+func validateDestination(errs *field.ErrorList, path *field.Path, destination *v1alpha3.Destination) {
+	if destination.GetHost() == "" {
+		*errs = append(*errs, field.Required(path.Child("destination", "host"), "the destination host is required"))
+	}
+}
+
+// validatePrecedence rejects names with a precedence suffix parsePrecedence cannot read
+func validatePrecedence(name string) error {
+	parts := strings.Split(name, "-")
+	suffix := parts[len(parts)-1]
+	if len(parts) > 1 && suffix == "" {
+		return fmt.Errorf("the name cannot end with '-'")
+	}
+	if len(parts) > 1 && strings.Trim(suffix, "0123456789") == "" {
+		if _, err := strconv.ParseInt(suffix, 10, 32); err != nil {
+			return fmt.Errorf("invalid precedence '%s': %w", suffix, err)
+		}
+	}
+	return nil
+}
+
+// validatePatch validates the patch with Istio's own validation: a VirtualService holding the
+// patch is created in a server-side dry run, for the validating webhook of Istio to check it.
+// A patch without hosts is given a placeholder host, the hosts come from the target when merged.
+func (in *VirtualServiceMerge) validatePatch(ctx reconciler.Context, errs *field.ErrorList) {
+	path := field.NewPath("spec", "patch")
+	vs := &alpha3.VirtualService{ObjectMeta: metav1.ObjectMeta{
+		Namespace:    in.Namespace,
+		GenerateName: in.Name + "-",
+	}}
+	in.Spec.Patch.DeepCopyInto(&vs.Spec)
+	if len(vs.Spec.Hosts) == 0 {
+		vs.Spec.Hosts = []string{in.Name}
+	}
+	err := ctx.Client().Create(context.TODO(), vs, client.DryRunAll)
+	switch {
+	case err == nil:
+	case errors.IsInvalid(err) || errors.IsBadRequest(err) || errors.IsForbidden(err):
+		// the admission webhooks deny the request as forbidden or as a bad request
+		*errs = append(*errs, field.Invalid(path, field.OmitValueType{}, err.Error()))
+	default:
+		*errs = append(*errs, field.InternalError(path, err))
+	}
+}
+
+// validateCollisions rejects the routes colliding with routes of another merge of the same target
+func (in *VirtualServiceMerge) validateCollisions(ctx reconciler.Context, errs *field.ErrorList) {
+	if in.Spec.Target.Name == "" {
+		return
+	}
+	merges := &VirtualServiceMergeList{}
+	if err := ctx.Client().List(context.TODO(), merges); err != nil {
+		*errs = append(*errs, field.InternalError(field.NewPath("spec", "target"), err))
+		return
+	}
+	ref := in.Spec.Target.Reference(in.Namespace)
+	httpRoutes := in.generateHttpRoutes(ctx.Logger())
+	tcpRefs, tlsRefs := in.TcpRouteRefs(), in.TlsRouteRefs()
+	for i := range merges.Items {
+		other := &merges.Items[i]
+		if other.UID == in.UID || (other.Namespace == in.Namespace && other.Name == in.Name) ||
+			other.Spec.Target.Reference(other.Namespace) != ref {
+			continue
+		}
+		owner := other.Namespace + "/" + other.Name
+		otherHttpRoutes, otherTcpRefs, otherTlsRefs := other.generateHttpRoutes(ctx.Logger()), other.TcpRouteRefs(), other.TlsRouteRefs()
+		for j, route := range httpRoutes {
+			for _, otherRoute := range otherHttpRoutes {
+				if route.Name == otherRoute.Name {
+					*errs = append(*errs, field.Duplicate(field.NewPath("spec", "patch", "http").Index(j).Child("name"),
+						fmt.Sprintf("%s, also merged into %s by %s", route.Name, ref, owner)))
+				}
+			}
+		}
+		for j, route := range tcpRefs {
+			for _, otherRoute := range otherTcpRefs {
+				if route.Match == otherRoute.Match {
+					*errs = append(*errs, field.Duplicate(field.NewPath("spec", "patch", "tcp").Index(j).Child("match"),
+						fmt.Sprintf("also merged into %s by %s", ref, owner)))
+				}
+			}
+		}
+		for j, route := range in.Spec.Patch.Tls {
+			for k, otherRoute := range other.Spec.Patch.Tls {
+				if tlsRefs[j].Match == otherTlsRefs[k].Match || TlsMatchesOverlap(route.Match, otherRoute.Match) {
+					*errs = append(*errs, field.Duplicate(field.NewPath("spec", "patch", "tls").Index(j).Child("match"),
+						fmt.Sprintf("overlaps the tls routes merged into %s by %s", ref, owner)))
+				}
+			}
+		}
+	}
+}
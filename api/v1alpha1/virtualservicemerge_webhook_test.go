@@ -0,0 +1,290 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/monimesl/operator-helper/reconciler"
+	"istio.io/api/networking/v1alpha3"
+	alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestValidateTarget(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "a"}}
+	tests := []struct {
+		name   string
+		target Target
+		dryRun bool
+		want   []string
+	}{
+		{name: "name", target: Target{Name: "vs"}},
+		{name: "host on a gateway", target: Target{Host: "a.example.com", Gateway: "gw"}},
+		{name: "selector", target: Target{Selector: selector}},
+		{name: "no target", want: []string{"spec.target.name"}},
+		{name: "name and host", target: Target{Name: "vs", Host: "a.example.com"}, want: []string{"spec.target"}},
+		{name: "gateway without host", target: Target{Name: "vs", Gateway: "gw"}, want: []string{"spec.target.gateway"}},
+		{name: "host created if missing", target: Target{Host: "a.example.com", CreateIfMissing: true}, want: []string{"spec.target.createIfMissing"}},
+		{name: "created without template", target: Target{Name: "vs", CreateIfMissing: true}, want: []string{"spec.target.template.hosts"}},
+		{name: "empty selector", target: Target{Selector: &metav1.LabelSelector{}}, want: []string{"spec.target.selector"}},
+		{name: "namespace selector without selector", target: Target{Name: "vs", NamespaceSelector: selector}, want: []string{"spec.target.namespaceSelector"}},
+		{name: "namespace and namespace selector", target: Target{Selector: selector, Namespace: "a", NamespaceSelector: selector}, want: []string{"spec.target.namespace"}},
+		{
+			name:   "invalid selector",
+			target: Target{Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Bad"}}}},
+			want:   []string{"spec.target.selector"},
+		},
+		{name: "dry run of a selector", target: Target{Selector: selector}, dryRun: true, want: []string{"spec.dryRun"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merge := newTestMerge("m")
+			merge.Spec.Target = tt.target
+			merge.Spec.DryRun = tt.dryRun
+			errs := field.ErrorList{}
+			merge.validateTarget(&errs)
+			assertStrings(t, errorFields(errs), tt.want...)
+		})
+	}
+}
+
+func TestValidateHttpRoutes(t *testing.T) {
+	priority := int32(1)
+	tests := []struct {
+		name       string
+		routes     []*v1alpha3.HTTPRoute
+		priorities map[string]int32
+		priority   *int32
+		want       []string
+	}{
+		{name: "route", routes: []*v1alpha3.HTTPRoute{httpRoute("api-1", "a")}},
+		{name: "redirect", routes: []*v1alpha3.HTTPRoute{{Name: "api-1", Redirect: &v1alpha3.HTTPRedirect{Uri: "/"}}}},
+		{name: "direct response", routes: []*v1alpha3.HTTPRoute{{Name: "api-1", DirectResponse: &v1alpha3.HTTPDirectResponse{Status: 404}}}},
+		{name: "delegate", routes: []*v1alpha3.HTTPRoute{{Name: "api-1", Delegate: &v1alpha3.Delegate{Name: "vs"}}}},
+		{name: "no destination", routes: []*v1alpha3.HTTPRoute{{Name: "api-1"}}, want: []string{"spec.patch.http[0].route"}},
+		{
+			name:   "destination without host",
+			routes: []*v1alpha3.HTTPRoute{{Name: "api-1", Route: []*v1alpha3.HTTPRouteDestination{{Destination: &v1alpha3.Destination{}}}}},
+			want:   []string{"spec.patch.http[0].route[0].destination.host"},
+		},
+		{
+			name:   "duplicate names",
+			routes: []*v1alpha3.HTTPRoute{httpRoute("api-1", "a"), httpRoute("api-1", "b")},
+			want:   []string{"spec.patch.http[1].name"},
+		},
+		{name: "invalid precedence", routes: []*v1alpha3.HTTPRoute{httpRoute("api-99999999999", "a")}, want: []string{"spec.patch.http[0].name"}},
+		{name: "name ending with a dash", routes: []*v1alpha3.HTTPRoute{httpRoute("api-", "a")}, want: []string{"spec.patch.http[0].name"}},
+		{name: "precedence ignored with a priority", routes: []*v1alpha3.HTTPRoute{httpRoute("api-", "a")}, priority: &priority},
+		{
+			name:       "priority of an unknown route",
+			routes:     []*v1alpha3.HTTPRoute{httpRoute("api-1", "a")},
+			priorities: map[string]int32{"web": 1},
+			want:       []string{"spec.routePriorities[web]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merge := newTestMerge("m")
+			merge.Spec.Patch.Http = tt.routes
+			merge.Spec.RoutePriorities = tt.priorities
+			merge.Spec.Priority = tt.priority
+			errs := field.ErrorList{}
+			merge.validateHttpRoutes(&errs)
+			assertStrings(t, errorFields(errs), tt.want...)
+		})
+	}
+}
+
+func TestValidateTcpAndTlsRoutes(t *testing.T) {
+	destination := []*v1alpha3.RouteDestination{{Destination: &v1alpha3.Destination{Host: "a"}}}
+	merge := newTestMerge("m")
+	merge.Spec.Patch.Tcp = []*v1alpha3.TCPRoute{
+		{Match: []*v1alpha3.L4MatchAttributes{{Port: 5432}}, Route: destination},
+		{Route: destination},
+		{Match: []*v1alpha3.L4MatchAttributes{{Port: 5432}}},
+	}
+	merge.Spec.TcpRouteKeys = []string{"a", "b", "c", "d"}
+	merge.Spec.Patch.Tls = []*v1alpha3.TLSRoute{
+		{Match: []*v1alpha3.TLSMatchAttributes{{SniHosts: []string{"a.example.com"}}}, Route: destination},
+		{Match: []*v1alpha3.TLSMatchAttributes{{Port: 443}}, Route: destination},
+	}
+	errs := field.ErrorList{}
+	merge.validateTcpRoutes(&errs)
+	merge.validateTlsRoutes(&errs)
+	assertStrings(t, errorFields(errs),
+		"spec.patch.tcp[1].match",
+		"spec.patch.tcp[2].route",
+		"spec.tcpRouteKeys",
+		"spec.patch.tls[1].match[0].sniHosts",
+	)
+}
+
+func errorFields(errs field.ErrorList) []string {
+	fields := make([]string, len(errs))
+	for i, err := range errs {
+		fields[i] = err.Field
+	}
+	return fields
+}
+
+func TestValidatePatch(t *testing.T) {
+	virtualServices := schema.GroupResource{Group: "networking.istio.io", Resource: "virtualservices"}
+	tests := []struct {
+		name string
+		// err is the error of the dry run create of the VirtualService holding the patch
+		err  error
+		want field.ErrorType
+	}{
+		{name: "valid"},
+		{
+			name: "denied by the webhook of Istio",
+			err:  errors.NewForbidden(virtualServices, "", fmt.Errorf(`admission webhook "validation.istio.io" denied the request: configuration is invalid`)),
+			want: field.ErrorTypeInvalid,
+		},
+		{name: "invalid", err: errors.NewInvalid(schema.GroupKind{Group: "networking.istio.io", Kind: "VirtualService"}, "m-x", nil), want: field.ErrorTypeInvalid},
+		{name: "api server unavailable", err: errors.NewServiceUnavailable("unavailable"), want: field.ErrorTypeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created *alpha3.VirtualService
+			var createOpts client.CreateOptions
+			kclient := fake.NewClientBuilder().WithScheme(testScheme(t)).WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(_ context.Context, _ client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+					created = obj.(*alpha3.VirtualService)
+					createOpts.ApplyOptions(opts)
+					return tt.err
+				},
+			}).Build()
+			merge := newTestMerge("m")
+			merge.Spec.Patch.Http = []*v1alpha3.HTTPRoute{httpRoute("api-1", "a")}
+			errs := field.ErrorList{}
+			merge.validatePatch(testContext{client: kclient}, &errs)
+
+			if created == nil || created.Namespace != "default" || len(createOpts.DryRun) == 0 {
+				t.Fatalf("created %v with %v, want a dry run in the namespace of the merge", created, createOpts)
+			}
+			assertStrings(t, created.Spec.Hosts, "m")
+			assertStrings(t, httpDestinations(created.Spec.Http), "api-1:a")
+			if tt.want == "" {
+				assertStrings(t, errorFields(errs))
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != "spec.patch" || errs[0].Type != tt.want {
+				t.Errorf("errors = %v, want a %s error of spec.patch", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCollisions(t *testing.T) {
+	tcp := []*v1alpha3.TCPRoute{{
+		Match: []*v1alpha3.L4MatchAttributes{{Port: 5432}},
+		Route: []*v1alpha3.RouteDestination{{Destination: &v1alpha3.Destination{Host: "db"}}},
+	}}
+	tls := func(hosts ...string) []*v1alpha3.TLSRoute {
+		return []*v1alpha3.TLSRoute{{
+			Match: []*v1alpha3.TLSMatchAttributes{{Port: 443, SniHosts: hosts}},
+			Route: []*v1alpha3.RouteDestination{{Destination: &v1alpha3.Destination{Host: "tls"}}},
+		}}
+	}
+	newMerge := func(name, target string) *VirtualServiceMerge {
+		merge := newTestMerge(name)
+		merge.Spec.Target.Name = target
+		merge.Spec.Patch.Http = []*v1alpha3.HTTPRoute{httpRoute("api-1", name), httpRoute("", name)}
+		merge.Spec.Patch.Tcp = tcp
+		merge.Spec.Patch.Tls = tls("a.example.com")
+		return merge
+	}
+	tests := []struct {
+		name   string
+		others []*VirtualServiceMerge
+		want   []string
+	}{
+		{name: "no other merge"},
+		{name: "merge of another target", others: []*VirtualServiceMerge{newMerge("other", "vs2")}},
+		{
+			name:   "merge of the same target",
+			others: []*VirtualServiceMerge{newMerge("other", "vs")},
+			want:   []string{"spec.patch.http[0].name", "spec.patch.tcp[0].match", "spec.patch.tls[0].match"},
+		},
+		{
+			name: "overlapping tls routes",
+			others: []*VirtualServiceMerge{func() *VirtualServiceMerge {
+				other := newTestMerge("other")
+				other.Spec.Patch.Tls = tls("*.example.com")
+				return other
+			}()},
+			want: []string{"spec.patch.tls[0].match"},
+		},
+		{
+			name: "previous version of the merge",
+			others: []*VirtualServiceMerge{func() *VirtualServiceMerge {
+				previous := newMerge("m", "vs")
+				previous.ResourceVersion = "1"
+				return previous
+			}()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := fake.NewClientBuilder().WithScheme(testScheme(t))
+			for _, other := range tt.others {
+				builder.WithObjects(other)
+			}
+			merge := newMerge("m", "vs")
+			errs := field.ErrorList{}
+			merge.validateCollisions(testContext{client: builder.Build()}, &errs)
+			assertStrings(t, errorFields(errs), tt.want...)
+		})
+	}
+}
+
+// testContext is a reconciler context serving the client of the tests
+type testContext struct {
+	reconciler.Context
+	client client.Client
+}
+
+func (in testContext) Client() client.Client {
+	return in.client
+}
+
+func (in testContext) Logger() logr.Logger {
+	return logr.Discard()
+}
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := alpha3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
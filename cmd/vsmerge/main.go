@@ -0,0 +1,187 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// vsmerge renders VirtualServiceMerge objects onto a VirtualService locally, with
+// the same merge logic as the operator, and prints the resulting VirtualService.
+//
+//	vsmerge [-n namespace] [-v] [-diff] vs.yaml vs-merge-1.yaml vs-merge-2.yaml ...
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/go-logr/logr"
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
+)
+
+var documentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+func main() {
+	var namespace string
+	var verbose bool
+	var diff bool
+	flag.StringVar(&namespace, "n", "default", "Namespace of the objects which do not set one")
+	flag.BoolVar(&verbose, "v", false, "Log the merge steps to stderr")
+	flag.BoolVar(&diff, "diff", false, "Print the changes made to the VirtualService instead of the merged VirtualService")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] virtualservice.yaml merge.yaml...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	log := logr.Discard()
+	if verbose {
+		log = zap.New(zap.WriteTo(os.Stderr), zap.UseDevMode(true))
+	}
+	target, err := readTarget(flag.Arg(0), namespace)
+	if err != nil {
+		fail(err)
+	}
+	merges := make([]*v1alpha1.VirtualServiceMerge, 0)
+	for _, file := range flag.Args()[1:] {
+		objects, err := readMerges(file, namespace)
+		if err != nil {
+			fail(err)
+		}
+		merges = append(merges, objects...)
+	}
+	before := target.Spec.DeepCopy()
+	if err = render(log, target, merges); err != nil {
+		fail(err)
+	}
+	if diff {
+		printDiff(v1alpha1.DiffTargets(before, &target.Spec))
+		return
+	}
+	data, err := yaml.Marshal(target)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Print(string(data))
+}
+
+// render applies the merges targeting the VirtualService in order, like the operator
+// does when they are reconciled one after the other, and reports their issues.
+func render(log logr.Logger, target *istio.VirtualService, merges []*v1alpha1.VirtualServiceMerge) error {
+	ledger, err := v1alpha1.ReadLedger(target)
+	if err != nil {
+		return err
+	}
+	applied := make([]*v1alpha1.VirtualServiceMerge, 0)
+	for _, merge := range merges {
+		if !merge.Spec.Target.Matches(merge.Namespace, target) {
+			fmt.Fprintf(os.Stderr, "skipping %s/%s: it targets %s\n", merge.Namespace, merge.Name, merge.Spec.Target.String(merge.Namespace))
+			continue
+		}
+		protected := merge.AddTcpRoutes(target, ledger)
+		protected = append(protected, merge.AddTlsRoutes(target, ledger)...)
+		protected = append(protected, merge.AddHttpRoutes(log, target, ledger)...)
+		merge.AddListFields(target, ledger)
+		for _, route := range protected {
+			fmt.Fprintf(os.Stderr, "%s/%s: route not merged: %s\n", merge.Namespace, merge.Name, route)
+		}
+		applied = append(applied, merge)
+	}
+	for _, merge := range applied {
+		for _, route := range merge.ShadowedRoutes(target) {
+			fmt.Fprintf(os.Stderr, "%s/%s: route never reached: %s\n", merge.Namespace, merge.Name, route)
+		}
+	}
+	return ledger.Write(target)
+}
+
+func printDiff(diff v1alpha1.TargetDiff) {
+	for _, change := range []struct {
+		sign string
+		keys []string
+	}{{"+", diff.Added}, {"~", diff.Replaced}, {"-", diff.Removed}, {"^", diff.Reordered}} {
+		for _, key := range change.keys {
+			fmt.Printf("%s %s\n", change.sign, key)
+		}
+	}
+}
+
+func readTarget(file, namespace string) (*istio.VirtualService, error) {
+	documents, err := readDocuments(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(documents) != 1 {
+		return nil, fmt.Errorf("%s: expected a single VirtualService, found %d documents", file, len(documents))
+	}
+	target := &istio.VirtualService{}
+	if err = yaml.Unmarshal(documents[0], target); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if target.Namespace == "" {
+		target.Namespace = namespace
+	}
+	return target, nil
+}
+
+func readMerges(file, namespace string) ([]*v1alpha1.VirtualServiceMerge, error) {
+	documents, err := readDocuments(file)
+	if err != nil {
+		return nil, err
+	}
+	merges := make([]*v1alpha1.VirtualServiceMerge, 0, len(documents))
+	for _, document := range documents {
+		merge := &v1alpha1.VirtualServiceMerge{}
+		if err = yaml.Unmarshal(document, merge); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if merge.Namespace == "" {
+			merge.Namespace = namespace
+		}
+		if merge.UID == "" {
+			// the ownership of the routes is tracked by uid
+			merge.UID = types.UID(merge.Namespace + "/" + merge.Name)
+		}
+		merges = append(merges, merge)
+	}
+	return merges, nil
+}
+
+// readDocuments returns the non empty YAML documents of the file
+func readDocuments(file string) ([][]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([][]byte, 0)
+	for _, document := range documentSeparator.Split(string(data), -1) {
+		if len(bytes.TrimSpace([]byte(document))) > 0 {
+			documents = append(documents, []byte(document))
+		}
+	}
+	return documents, nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -23,11 +23,14 @@ import (
 	"github.com/monimesl/operator-helper/reconciler"
 	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
 	kerr "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
@@ -38,18 +41,32 @@ type VirtualServicePatchReconciler struct {
 	reconciler.Context
 	IstioClient    *versionedclient.Clientset
 	OldObjectCache cache.Indexer
+	FieldIndexer   client.FieldIndexer
+	// Recorder emits the events of the merges
+	Recorder record.EventRecorder
+	Options  Options
+	// MaxConcurrentReconciles is the number of merges reconciled in parallel.
+	// Merges of the same target are still reconciled one at a time.
+	MaxConcurrentReconciles int
+	targetLocks             keyedMutex
 }
 
 func (r *VirtualServicePatchReconciler) Configure(ctx reconciler.Context) error {
 	r.Context = ctx
+	if err := r.FieldIndexer.IndexField(context.TODO(), &v1alpha1.VirtualServiceMerge{}, targetIndexField, indexTarget); err != nil {
+		return err
+	}
 	return ctx.NewControllerBuilder().
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		For(&v1alpha1.VirtualServiceMerge{}, builder.WithPredicates(
 			predicate.Funcs{
 				CreateFunc: func(e event.CreateEvent) bool {
+					unreconciled.created(e.Object.(*v1alpha1.VirtualServiceMerge))
 					return true
 				},
 				UpdateFunc: func(e event.UpdateEvent) bool {
 					_ = r.OldObjectCache.Add(e.ObjectOld)
+					unreconciled.updated(e.ObjectOld.(*v1alpha1.VirtualServiceMerge), e.ObjectNew.(*v1alpha1.VirtualServiceMerge))
 					return true
 				},
 				DeleteFunc: func(e event.DeleteEvent) bool {
@@ -68,31 +85,49 @@ func (r *VirtualServicePatchReconciler) Configure(ctx reconciler.Context) error
 			if !vs.GetDeletionTimestamp().IsZero() {
 				return requests
 			}
-			// get all virtual service merge whose target is this virtual service
-			vsmegeList := &v1alpha1.VirtualServiceMergeList{}
-			if err := r.Client().List(context.TODO(), vsmegeList, &client.ListOptions{
-				Namespace: vs.GetNamespace(),
-			}); err != nil {
-				panic(err)
+			// get all virtual service merge of any namespace whose target is this virtual service, along
+			// with the selectors and hosts matching it now so that label and host changes are followed
+			vsmegeList, err := listMerges(ctx2, r.Context, v1alpha1.TargetReference{Name: vs.GetName(), Namespace: vs.GetNamespace()})
+			var selectors *v1alpha1.VirtualServiceMergeList
+			if err == nil {
+				selectors, err = listResolving(ctx2, r.Context)
+			}
+			if err != nil {
+				// the merges are re-applied by the periodic resync
+				r.Context.Logger().Error(err, "Failed to list the merges of the virtual service",
+					"target", vs.GetNamespace()+"/"+vs.GetName())
+				virtualServiceMappingErrors.Inc()
+				return requests
 			}
-			for _, vsmerge := range vsmegeList.Items {
-				targetNamespace := vsmerge.Spec.Target.Namespace
-				if targetNamespace == "" {
-					targetNamespace = vsmerge.GetNamespace()
+			for i := range vsmegeList.Items {
+				vsmerge := &vsmegeList.Items[i]
+				request := reconcile.Request{
+					NamespacedName: types.NamespacedName{
+						Namespace: vsmerge.GetNamespace(),
+						Name:      vsmerge.GetName(),
+					},
 				}
-				// only look for vs that is a target for any of the merge
-				if vsmerge.Spec.Target.Name == vs.GetName() && targetNamespace == vs.GetNamespace() {
-					request := reconcile.Request{
-						NamespacedName: types.NamespacedName{
-							Namespace: vsmerge.GetNamespace(),
-							Name:      vsmerge.GetName(),
-						},
-					}
-					requests = append(requests, request)
+				requests = append(requests, request)
+			}
+			for i := range selectors.Items {
+				if vsmerge := &selectors.Items[i]; vsmerge.Spec.Target.Matches(vsmerge.Namespace, vs) {
+					requests = append(requests, reconcile.Request{
+						NamespacedName: types.NamespacedName{Namespace: vsmerge.Namespace, Name: vsmerge.Name},
+					})
 				}
 			}
 			return requests
 		})).
+		// the VirtualServices of a namespace whose labels changed may be selected or not anymore
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(func(ctx2 context.Context, obj client.Object) []reconcile.Request {
+			requests, err := namespaceSelecting(ctx2, r.Context)
+			if err != nil {
+				// the merges are re-applied by the periodic resync
+				r.Context.Logger().Error(err, "Failed to list the merges selecting namespaces", "namespace", obj.GetName())
+				return nil
+			}
+			return requests
+		})).
 		Complete(r)
 }
 
@@ -103,11 +138,13 @@ func (r *VirtualServicePatchReconciler) Reconcile(_ context.Context, request rec
 		return reconcile.Result{}, err
 	}
 	result, err := r.Run(request, patch, func(_ bool) error {
+		unlock := r.targetLocks.Lock(r.targetKeys(patch, oldObj)...)
+		defer unlock()
 		if exists {
-			if err := Reconcile(r.Context, r.IstioClient, patch, oldObj); err != nil {
+			if err := Reconcile(r.Context, r.IstioClient, r.Recorder, patch, oldObj, r.Options); err != nil {
 				if kerr.IsNotFound(err) {
 					// do not need to panic just log output
-					r.Context.Logger().Info("Virtual service not found. Nothing to sync.")
+					mergeLogger(r.Context, patch).Info("Target VirtualService not found, nothing to sync")
 					// update completed, remove key from cache
 					_ = r.OldObjectCache.Delete(oldObj)
 					return nil
@@ -117,10 +154,10 @@ func (r *VirtualServicePatchReconciler) Reconcile(_ context.Context, request rec
 			// update completed, remove key from cache
 			_ = r.OldObjectCache.Delete(oldObj)
 		} else {
-			if err := Reconcile(r.Context, r.IstioClient, patch, nil); err != nil {
+			if err := Reconcile(r.Context, r.IstioClient, r.Recorder, patch, nil, r.Options); err != nil {
 				if kerr.IsNotFound(err) {
 					// do not need to panic just log output
-					r.Context.Logger().Info("Virtual service not found. Nothing to sync.")
+					mergeLogger(r.Context, patch).Info("Target VirtualService not found, nothing to sync")
 					return nil
 				}
 				return err
@@ -128,5 +165,44 @@ func (r *VirtualServicePatchReconciler) Reconcile(_ context.Context, request rec
 		}
 		return nil
 	})
+	if patch.UID == "" {
+		// the merge is gone
+		unreconciled.track(request.NamespacedName.String(), nil, false)
+	} else {
+		unreconciled.track(request.NamespacedName.String(), patch, err == nil)
+	}
+	if err == nil && r.Options.ResyncPeriod > 0 {
+		result.RequeueAfter = r.Options.ResyncPeriod
+	}
 	return result, err
 }
+
+// targetKeys returns the keys of the targets the merge is written to, the old one included
+func (r *VirtualServicePatchReconciler) targetKeys(patch *v1alpha1.VirtualServiceMerge, oldObj interface{}) []string {
+	keys := []string{patch.Spec.Target.Reference(patch.Namespace).String()}
+	for _, ref := range patch.Status.Targets {
+		keys = append(keys, ref.String())
+	}
+	if patch.Spec.Target.Host != "" {
+		if patch.Status.Target != nil {
+			keys = append(keys, patch.Status.Target.String())
+		}
+		// an unresolved host is reported by the reconcile
+		if ref, err := resolveTarget(context.TODO(), r.Context, patch); err == nil {
+			keys = append(keys, ref.String())
+		}
+	}
+	if patch.Spec.Target.IsSelector() {
+		// a failed selection is reported by the reconcile
+		refs, _ := selectTargets(context.TODO(), r.Context, patch)
+		for _, ref := range refs {
+			keys = append(keys, ref.String())
+		}
+	}
+	if oldPatch, ok := oldObj.(*v1alpha1.VirtualServiceMerge); ok {
+		if ref, applied := appliedTarget(oldPatch); applied {
+			keys = append(keys, ref.String())
+		}
+	}
+	return keys
+}
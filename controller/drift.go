@@ -0,0 +1,227 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/operator-helper/oputil"
+	"github.com/monimesl/operator-helper/reconciler"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+// targetDrifted reports whether the routes or values the patch contributes are missing from the
+// target or were modified since they were applied, whatever the generation of the merge. The patch
+// is applied to a copy of the cached target and compared to it; a missing target the merge creates
+// is drifted as well. The order of the routes is left out, re-applying a merge moves its routes
+// before the routes of the merges applied after it.
+func targetDrifted(ctx reconciler.Context, recorder record.EventRecorder, patch *v1alpha1.VirtualServiceMerge, ref v1alpha1.TargetReference, opts Options) (bool, error) {
+	target := &istio.VirtualService{}
+	err := ctx.Client().Get(context.TODO(), types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, target)
+	if kerr.IsNotFound(err) {
+		if !createsTarget(patch, ref) {
+			return false, nil
+		}
+		reportDrift(ctx, recorder, patch, nil, ref, "the VirtualService is missing")
+		return true, nil
+	}
+	if err != nil || !target.DeletionTimestamp.IsZero() {
+		return false, err
+	}
+	rendered := target.DeepCopy()
+	apply := mergeTarget
+	if opts.FullRender {
+		apply = renderTarget
+	}
+	if _, err := apply(ctx, rendered, patch.DeepCopy(), nil, false); err != nil {
+		return false, err
+	}
+	diff := v1alpha1.DiffTargets(&target.Spec, &rendered.Spec)
+	drifted := append(append([]string{}, diff.Added...), diff.Replaced...)
+	if len(drifted) == 0 {
+		return false, nil
+	}
+	reportDrift(ctx, recorder, patch, target, ref, "missing or modified: "+strings.Join(drifted, ", "))
+	return true, nil
+}
+
+func reportDrift(ctx reconciler.Context, recorder record.EventRecorder, patch *v1alpha1.VirtualServiceMerge, target *istio.VirtualService, ref v1alpha1.TargetReference, drift string) {
+	targetDrifts.WithLabelValues(ref.String()).Inc()
+	targetLogger(ctx, patch, ref.String()).Info("Target VirtualService drifted, re-applying the patch", "drift", drift)
+	recordEvent(recorder, patch, target, corev1.EventTypeWarning, v1alpha1.ReasonDrifted,
+		fmt.Sprintf("VirtualService %s drifted from the patch, %s", ref, drift))
+}
+
+// CheckDrift re-renders every target from its merges each DriftCheckPeriod and fixes the targets
+// which drifted from them, or only reports them with DriftReportOnly, until ctx is done.
+func (r *VirtualServicePatchReconciler) CheckDrift(ctx context.Context) error {
+	if r.Options.DriftCheckPeriod <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(r.Options.DriftCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			r.checkDrift(ctx)
+		}
+	}
+}
+
+func (r *VirtualServicePatchReconciler) checkDrift(ctx context.Context) {
+	merges := &v1alpha1.VirtualServiceMergeList{}
+	if err := r.Client().List(ctx, merges); err != nil {
+		r.Logger().Error(err, "Failed to list the merges to check the drift of their targets")
+		return
+	}
+	targets := map[v1alpha1.TargetReference]bool{}
+	for i := range merges.Items {
+		merge := &merges.Items[i]
+		for ref := range appliedTargets(merge) {
+			targets[ref] = true
+		}
+		if merge.Spec.Target.Name != "" {
+			targets[merge.Spec.Target.Reference(merge.Namespace)] = true
+		}
+	}
+	for ref := range targets {
+		if err := r.checkTargetDrift(ctx, ref); err != nil && !kerr.IsNotFound(err) {
+			r.Logger().Error(err, "Failed to check the drift of the target VirtualService", "target", ref.String())
+		}
+	}
+}
+
+// checkTargetDrift renders the target from its live merges and from its routes not coming from a
+// merge, and writes it when it differs from the live one. The routes of the merges not found anymore
+// are removed. The order of the routes is left out, it depends on the order the merges were applied in.
+func (r *VirtualServicePatchReconciler) checkTargetDrift(ctx context.Context, ref v1alpha1.TargetReference) error {
+	unlock := r.targetLocks.Lock(ref.String())
+	defer unlock()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		live, err := r.IstioClient.NetworkingV1alpha3().VirtualServices(ref.Namespace).
+			Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil || !live.DeletionTimestamp.IsZero() {
+			return err
+		}
+		rendered := live.DeepCopy()
+		if err := r.renderMerges(ctx, rendered); err != nil {
+			return err
+		}
+		diff := v1alpha1.DiffTargets(&live.Spec, &rendered.Spec)
+		drift := v1alpha1.TargetDiff{Added: diff.Added, Replaced: diff.Replaced, Removed: diff.Removed}
+		if drift.Empty() {
+			return nil
+		}
+		if r.Options.DriftReportOnly {
+			r.reportTargetDrift(live, ref, drift, false)
+			return nil
+		}
+		if err := writeTarget(r.IstioClient, rendered, r.Options); err != nil {
+			return err
+		}
+		r.reportTargetDrift(live, ref, drift, true)
+		return nil
+	})
+}
+
+// renderMerges applies the reconciled merges of the target onto it, after removing the routes of
+// the merges not found anymore. Merges not reconciled yet are left to their own reconcile, and with
+// the full render the whole target is, as rendering it would drop the routes they merged so far.
+func (r *VirtualServicePatchReconciler) renderMerges(ctx context.Context, target *istio.VirtualService) error {
+	ref := v1alpha1.TargetReference{Name: target.Name, Namespace: target.Namespace}
+	list, err := listMerges(ctx, r.Context, ref)
+	if err != nil {
+		return err
+	}
+	ledger, err := v1alpha1.ReadLedger(target)
+	if err != nil {
+		return err
+	}
+	owners := map[types.UID]bool{}
+	for _, owner := range ledger {
+		owners[owner.UID] = true
+	}
+	listed := map[types.UID]bool{}
+	merges := make([]*v1alpha1.VirtualServiceMerge, 0)
+	pending := false
+	for i := range list.Items {
+		merge := &list.Items[i]
+		listed[merge.UID] = true
+		if !merge.DeletionTimestamp.IsZero() || merge.Spec.DryRun || merge.Generation != merge.Status.ObservedGeneration ||
+			!oputil.Contains(merge.Finalizers, finalizerName) || !merge.Spec.Target.Matches(merge.Namespace, target) {
+			pending = pending || owners[merge.UID]
+			continue
+		}
+		merges = append(merges, merge)
+	}
+	orphans := make([]*v1alpha1.VirtualServiceMerge, 0)
+	for _, owner := range ledger {
+		if !listed[owner.UID] {
+			listed[owner.UID] = true
+			orphans = append(orphans, &v1alpha1.VirtualServiceMerge{
+				ObjectMeta: metav1.ObjectMeta{Name: owner.Name, Namespace: owner.Namespace, UID: owner.UID},
+			})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].UID < orphans[j].UID
+	})
+	if r.Options.FullRender {
+		if pending {
+			return nil
+		}
+		// the merges not found anymore are left out of the render
+		if len(merges) > 0 || len(orphans) > 0 {
+			sortMerges(merges)
+			_, err = render(r.Context, target, merges, nil)
+		}
+		return err
+	}
+	for _, orphan := range orphans {
+		if _, err := mergeTarget(r.Context, target, orphan, nil, true); err != nil {
+			return err
+		}
+	}
+	if len(merges) > 0 {
+		_, err = mergeTarget(r.Context, target, merges[0], merges[1:], false)
+	}
+	return err
+}
+
+func (r *VirtualServicePatchReconciler) reportTargetDrift(target *istio.VirtualService, ref v1alpha1.TargetReference, drift v1alpha1.TargetDiff, fixed bool) {
+	targetDrifts.WithLabelValues(ref.String()).Inc()
+	message := "Drifted from its merges, fixed: "
+	if !fixed {
+		message = "Drifted from its merges, not fixed: "
+	}
+	r.Logger().Info("Target VirtualService drifted from its merges", "target", ref.String(), "fixed", fixed,
+		"added", drift.Added, "replaced", drift.Replaced, "removed", drift.Removed)
+	r.Recorder.Event(target, corev1.EventTypeWarning, v1alpha1.ReasonDrifted, message+drift.String())
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	networkingv1alpha3 "istio.io/api/networking/v1alpha3"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("renderMerges", func() {
+	newMerge := func(name, destination string) *v1alpha1.VirtualServiceMerge {
+		merge := &v1alpha1.VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: name, UID: types.UID(name + "-uid"),
+			Finalizers: []string{finalizerName}, Generation: 1,
+		}}
+		merge.Spec.Target.Name = "reviews"
+		merge.Spec.Patch.Http = []*networkingv1alpha3.HTTPRoute{{
+			Name:  name + "-1",
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: destination}}},
+		}}
+		merge.Status.ObservedGeneration = 1
+		return merge
+	}
+	// newTarget returns the target with a base route and the routes of the applied merges
+	newTarget := func(applied ...*v1alpha1.VirtualServiceMerge) *istio.VirtualService {
+		target := &istio.VirtualService{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reviews"}}
+		target.Spec.Http = []*networkingv1alpha3.HTTPRoute{{
+			Name:  "default",
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: "reviews"}}},
+		}}
+		ledger := v1alpha1.OwnershipLedger{}
+		for _, merge := range applied {
+			Expect(merge.DeepCopy().AddHttpRoutes(logr.Discard(), target, ledger)).To(BeEmpty())
+		}
+		Expect(ledger.Write(target)).To(Succeed())
+		return target
+	}
+	destinations := func(target *istio.VirtualService) []string {
+		hosts := make([]string, 0)
+		for _, route := range target.Spec.Http {
+			hosts = append(hosts, route.Route[0].Destination.Host)
+		}
+		return hosts
+	}
+
+	for _, fullRender := range []bool{false, true} {
+		opts := Options{FullRender: fullRender}
+		mode := "incrementally"
+		if fullRender {
+			mode = "with the full render"
+		}
+
+		It("re-applies the reconciled merges "+mode, func() {
+			merge := newMerge("m", "v1")
+			target := newTarget(merge)
+			target.Spec.Http[0].Route[0].Destination.Host = "edited"
+			r := &VirtualServicePatchReconciler{Context: newTestContext(merge), Options: opts}
+			Expect(r.renderMerges(context.TODO(), target)).To(Succeed())
+			Expect(destinations(target)).To(ConsistOf("v1", "reviews"))
+		})
+
+		It("leaves the merges not reconciled yet to their own reconcile "+mode, func() {
+			reconciled := newMerge("a", "a")
+			pending := newMerge("m", "v2")
+			pending.Generation = 2
+			target := newTarget(reconciled, newMerge("m", "v1"))
+			unfinalized := newMerge("n", "n")
+			unfinalized.Finalizers = nil
+			r := &VirtualServicePatchReconciler{Context: newTestContext(reconciled, pending, unfinalized), Options: opts}
+			Expect(r.renderMerges(context.TODO(), target)).To(Succeed())
+			Expect(destinations(target)).To(ConsistOf("a", "v1", "reviews"))
+		})
+
+		It("removes the routes of the merges not found anymore "+mode, func() {
+			merge := newMerge("m", "v1")
+			target := newTarget(merge, newMerge("deleted", "deleted"))
+			r := &VirtualServicePatchReconciler{Context: newTestContext(merge), Options: opts}
+			Expect(r.renderMerges(context.TODO(), target)).To(Succeed())
+			Expect(destinations(target)).To(ConsistOf("v1", "reviews"))
+		})
+	}
+})
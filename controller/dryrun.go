@@ -0,0 +1,92 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/operator-helper/reconciler"
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var errDryRunSelector = errors.New("a dry run needs a target name, not a selector")
+
+// dryRun renders the target with the patch applied into the status of the patch, without writing the target
+func dryRun(ctx reconciler.Context, client versionedclient.Interface, patch *v1alpha1.VirtualServiceMerge, ref v1alpha1.TargetReference, opts Options) error {
+	if err := patch.Spec.Target.Validate(); err != nil {
+		return fmt.Errorf("virtualservicepatch.Reconcile: %w", err)
+	}
+	if patch.Spec.Target.IsSelector() {
+		return errDryRunSelector
+	}
+	target, err := client.NetworkingV1alpha3().VirtualServices(ref.Namespace).
+		Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if kerr.IsNotFound(err) && createsTarget(patch, ref) {
+		// rendered onto the VirtualService the merge would create
+		target, err = patch.Spec.Target.NewVirtualService(ref), nil
+	}
+	if err != nil {
+		return err
+	}
+	revision := target.ResourceVersion
+	before := target.Spec.DeepCopy()
+	// the patch status keeps listing what the merge actually contributed to the target
+	preview := patch.DeepCopy()
+	apply := mergeTarget
+	if opts.FullRender {
+		apply = renderTarget
+	}
+	conflicts, err := apply(ctx, target, preview, nil, false)
+	if err != nil {
+		return err
+	}
+	overlaps, err := findConflicts(ctx, preview, ref)
+	if err != nil {
+		return err
+	}
+	setConflicts(patch, append(conflicts[preview.UID], overlaps...))
+	setShadowed(patch, preview.ShadowedRoutes(target))
+	rendered, err := yaml.Marshal(&target.Spec)
+	if err != nil {
+		return err
+	}
+	patch.Status.DryRun = &v1alpha1.DryRunResult{
+		Generation:     patch.Generation,
+		TargetRevision: revision,
+		Rendered:       string(rendered),
+		Diff:           v1alpha1.DiffTargets(before, &target.Spec).String(),
+	}
+	return nil
+}
+
+// recordDryRun reflects a successful dry run of the patch onto its status
+func recordDryRun(patch *v1alpha1.VirtualServiceMerge, target v1alpha1.TargetReference) {
+	patch.Status.ObservedGeneration = patch.Generation
+	patch.Status.HandledRevision = patch.ResourceVersion
+	patch.Status.LastError = ""
+	patch.SetCondition(v1alpha1.ConditionTargetFound, metav1.ConditionTrue, v1alpha1.ReasonTargetFound,
+		fmt.Sprintf("VirtualService %s found", target))
+	patch.SetCondition(v1alpha1.ConditionApplied, metav1.ConditionFalse, v1alpha1.ReasonDryRun,
+		fmt.Sprintf("Dry run, the patch is rendered in the status instead of written to VirtualService %s", target))
+	patch.SetCondition(v1alpha1.ConditionReady, metav1.ConditionFalse, v1alpha1.ReasonDryRun, "")
+}
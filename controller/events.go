@@ -0,0 +1,48 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// recordEvent emits an event on the merge and, when given, on its target VirtualService
+func recordEvent(recorder record.EventRecorder, merge *v1alpha1.VirtualServiceMerge, target *istio.VirtualService, eventtype, reason, message string) {
+	recorder.Event(merge, eventtype, reason, message)
+	if target != nil {
+		recorder.Eventf(target, eventtype, reason, "%s (VirtualServiceMerge %s/%s)", message, merge.Namespace, merge.Name)
+	}
+}
+
+// reportCondition emits an event when the condition of the merge reached the status,
+// or changed its message, since the previous status of the merge.
+func reportCondition(recorder record.EventRecorder, merge *v1alpha1.VirtualServiceMerge, target *istio.VirtualService,
+	previous *v1alpha1.VirtualServicePatchStatus, conditionType string, status metav1.ConditionStatus, eventtype string) {
+	condition := meta.FindStatusCondition(merge.Status.Conditions, conditionType)
+	if condition == nil || condition.Status != status {
+		return
+	}
+	if old := meta.FindStatusCondition(previous.Conditions, conditionType); old != nil &&
+		old.Status == condition.Status && old.Message == condition.Message {
+		return
+	}
+	recordEvent(recorder, merge, target, eventtype, condition.Reason, condition.Message)
+}
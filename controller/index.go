@@ -0,0 +1,84 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/operator-helper/reconciler"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// targetIndexField indexes the merges by the namespace/name of their target
+const targetIndexField = "spec.target"
+
+// selectorIndexValue and hostIndexValue index the merges with a target selector or host,
+// which are also indexed by the namespace/name of the VirtualServices they were applied to
+const (
+	selectorIndexValue = "selector"
+	hostIndexValue     = "host"
+)
+
+func indexTarget(obj client.Object) []string {
+	merge := obj.(*v1alpha1.VirtualServiceMerge)
+	if merge.Spec.Target.IsSelector() {
+		values := []string{selectorIndexValue}
+		for _, ref := range merge.Status.Targets {
+			values = append(values, ref.String())
+		}
+		return values
+	}
+	if merge.Spec.Target.Host != "" {
+		values := []string{hostIndexValue}
+		if merge.Status.Target != nil {
+			values = append(values, merge.Status.Target.String())
+		}
+		return values
+	}
+	if merge.Spec.Target.Name == "" {
+		return nil
+	}
+	return []string{merge.Spec.Target.Reference(merge.Namespace).String()}
+}
+
+// listMerges returns the VirtualServiceMerges of any namespace targeting the VirtualService
+func listMerges(ctx context.Context, rctx reconciler.Context, ref v1alpha1.TargetReference) (*v1alpha1.VirtualServiceMergeList, error) {
+	return listIndexed(ctx, rctx, ref.String())
+}
+
+// listResolving returns the VirtualServiceMerges of any namespace with a target selector or host
+func listResolving(ctx context.Context, rctx reconciler.Context) (*v1alpha1.VirtualServiceMergeList, error) {
+	merges, err := listIndexed(ctx, rctx, selectorIndexValue)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := listIndexed(ctx, rctx, hostIndexValue)
+	if err != nil {
+		return nil, err
+	}
+	merges.Items = append(merges.Items, hosts.Items...)
+	return merges, nil
+}
+
+func listIndexed(ctx context.Context, rctx reconciler.Context, value string) (*v1alpha1.VirtualServiceMergeList, error) {
+	merges := &v1alpha1.VirtualServiceMergeList{}
+	if err := rctx.Client().List(ctx, merges, client.MatchingFields{targetIndexField: value}); err != nil {
+		return nil, err
+	}
+	return merges, nil
+}
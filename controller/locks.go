@@ -0,0 +1,81 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedMutex serializes the work done on the same keys, e.g. on the same
+// target VirtualService, while letting work on other keys run concurrently.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refCountedMutex
+}
+
+type refCountedMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks all the keys and returns the function unlocking them.
+// Keys are locked in order so that overlapping callers cannot deadlock.
+func (m *keyedMutex) Lock(keys ...string) (unlock func()) {
+	keys = uniqueSorted(keys)
+	locks := make([]*refCountedMutex, len(keys))
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*refCountedMutex{}
+	}
+	for i, key := range keys {
+		lock, ok := m.locks[key]
+		if !ok {
+			lock = &refCountedMutex{}
+			m.locks[key] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	m.mu.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i := len(keys) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+			if locks[i].refs--; locks[i].refs == 0 {
+				delete(m.locks, keys[i])
+			}
+		}
+	}
+}
+
+func uniqueSorted(keys []string) []string {
+	unique := make([]string, 0, len(keys))
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
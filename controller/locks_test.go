@@ -0,0 +1,90 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("keyedMutex", func() {
+	It("locks overlapping keys in any order without deadlocking", func() {
+		m := &keyedMutex{}
+		counts := map[string]int{}
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			keys := []string{"a", "b", "c"}
+			if i%2 == 0 {
+				keys = []string{"c", "a", "b", "a"}
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				unlock := m.Lock(keys...)
+				defer unlock()
+				for _, key := range keys {
+					counts[key]++
+				}
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		Eventually(done, 5*time.Second).Should(BeClosed())
+		Expect(counts).To(Equal(map[string]int{"a": 75, "b": 50, "c": 50}))
+	})
+
+	It("deletes the lock of a key once its last holder unlocks", func() {
+		m := &keyedMutex{}
+		unlock := m.Lock("a", "b")
+		acquired := make(chan func())
+		go func() {
+			acquired <- m.Lock("b")
+		}()
+		Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+		unlock()
+		var unlockB func()
+		Eventually(acquired).Should(Receive(&unlockB))
+		m.mu.Lock()
+		Expect(m.locks).To(HaveLen(1))
+		Expect(m.locks).To(HaveKey("b"))
+		m.mu.Unlock()
+		unlockB()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		Expect(m.locks).To(BeEmpty())
+	})
+
+	It("runs the work on disjoint keys concurrently", func() {
+		m := &keyedMutex{}
+		unlock := m.Lock("a")
+		defer unlock()
+		acquired := make(chan func())
+		go func() {
+			acquired <- m.Lock("b", "c")
+		}()
+		var unlockB func()
+		Eventually(acquired).Should(Receive(&unlockB))
+		unlockB()
+	})
+})
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	virtualServiceMappingErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "istiomerger_virtualservice_mapping_errors_total",
+		Help: "Number of VirtualService events whose merges could not be listed, left to the periodic resync",
+	})
+	mergesApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istiomerger_merges_applied_total",
+		Help: "Number of merges applied to their target VirtualService",
+	}, []string{"target"})
+	mergesRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istiomerger_merges_removed_total",
+		Help: "Number of merges removed from their target VirtualService",
+	}, []string{"target"})
+	mergesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istiomerger_merges_failed_total",
+		Help: "Number of failed writes of merges to their target VirtualService",
+	}, []string{"target"})
+	targetNotFound = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istiomerger_target_not_found_total",
+		Help: "Number of merges whose target VirtualService was not found",
+	}, []string{"target"})
+	targetUpdateConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istiomerger_target_update_conflicts_total",
+		Help: "Number of target VirtualService writes rejected as conflicting and retried",
+	}, []string{"target"})
+	targetDrifts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istiomerger_target_drifts_total",
+		Help: "Number of target VirtualServices found drifted from their merges",
+	}, []string{"target"})
+	targetUpdateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "istiomerger_target_update_duration_seconds",
+		Help:    "Duration of the writes of merges to their target VirtualService",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"action"})
+	contributedRoutes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "istiomerger_merge_contributed_routes",
+		Help: "Number of routes a merge contributed to its target VirtualService",
+	}, []string{"namespace", "name"})
+	oldestUnreconciledAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "istiomerger_oldest_unreconciled_merge_age_seconds",
+		Help: "Age of the oldest merge whose current generation is not applied yet",
+	}, unreconciled.oldest)
+)
+
+// unreconciled tracks the merges whose current generation is not applied yet
+var unreconciled = &pendingTracker{since: map[string]time.Time{}}
+
+func init() {
+	metrics.Registry.MustRegister(
+		virtualServiceMappingErrors,
+		mergesApplied,
+		mergesRemoved,
+		mergesFailed,
+		targetNotFound,
+		targetUpdateConflicts,
+		targetDrifts,
+		targetUpdateDuration,
+		contributedRoutes,
+		oldestUnreconciledAge,
+	)
+}
+
+// recordUpdate updates the metrics of the merges written to the target, or failed to be
+func recordUpdate(ref v1alpha1.TargetReference, patch *v1alpha1.VirtualServiceMerge, batch []*v1alpha1.VirtualServiceMerge, remove bool, started time.Time, err error) {
+	action := "apply"
+	if remove {
+		action = "remove"
+		contributedRoutes.DeleteLabelValues(patch.Namespace, patch.Name)
+	}
+	targetUpdateDuration.WithLabelValues(action).Observe(time.Since(started).Seconds())
+	switch {
+	case kerr.IsNotFound(err):
+		targetNotFound.WithLabelValues(ref.String()).Inc()
+	case err != nil:
+		mergesFailed.WithLabelValues(ref.String()).Inc()
+	default:
+		applied := append([]*v1alpha1.VirtualServiceMerge{}, batch...)
+		if remove {
+			mergesRemoved.WithLabelValues(ref.String()).Inc()
+		} else {
+			applied = append(applied, patch)
+		}
+		for _, merge := range applied {
+			mergesApplied.WithLabelValues(ref.String()).Inc()
+			contributedRoutes.WithLabelValues(merge.Namespace, merge.Name).Set(
+				float64(len(merge.Status.HttpRoutes) + len(merge.Status.TcpRoutes) + len(merge.Status.TlsRoutes)))
+		}
+	}
+}
+
+// pendingTracker remembers since when merges have a generation not applied yet
+type pendingTracker struct {
+	mu    sync.Mutex
+	since map[string]time.Time
+}
+
+// created starts the clock of a merge seen with a generation not applied yet, from its creation
+// when it was never reconciled as the operator may have been down since
+func (in *pendingTracker) created(merge *v1alpha1.VirtualServiceMerge) {
+	if merge.Generation != merge.Status.ObservedGeneration {
+		in.start(client.ObjectKeyFromObject(merge).String(), pendingSince(merge))
+	}
+}
+
+// updated starts the clock of a merge at the change of its generation
+func (in *pendingTracker) updated(old, merge *v1alpha1.VirtualServiceMerge) {
+	if merge.Generation != old.Generation {
+		in.start(client.ObjectKeyFromObject(merge).String(), time.Now())
+	}
+}
+
+// start records the merge of the key as pending since the time, unless it is pending already
+func (in *pendingTracker) start(key string, since time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if _, ok := in.since[key]; !ok {
+		in.since[key] = since
+	}
+}
+
+// track records the merge of the key as pending until it is reconciled, or gone when nil
+func (in *pendingTracker) track(key string, merge *v1alpha1.VirtualServiceMerge, reconciled bool) {
+	if merge == nil || (reconciled && merge.DeletionTimestamp.IsZero() && merge.Generation == merge.Status.ObservedGeneration) {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		delete(in.since, key)
+		return
+	}
+	// the clock started at the event of the merge, or now for a merge failing without a new generation
+	in.start(key, pendingSince(merge))
+}
+
+// pendingSince returns the creation of the merge when it was never reconciled, now otherwise
+func pendingSince(merge *v1alpha1.VirtualServiceMerge) time.Time {
+	if merge.Status.ObservedGeneration == 0 && !merge.CreationTimestamp.IsZero() {
+		return merge.CreationTimestamp.Time
+	}
+	return time.Now()
+}
+
+func (in *pendingTracker) oldest() float64 {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	age := 0.0
+	for _, since := range in.since {
+		if a := time.Since(since).Seconds(); a > age {
+			age = a
+		}
+	}
+	return age
+}
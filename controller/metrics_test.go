@@ -0,0 +1,75 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("pendingTracker", func() {
+	const key = "default/m"
+	var tracker *pendingTracker
+
+	newMerge := func(age time.Duration, generation, observed int64) *v1alpha1.VirtualServiceMerge {
+		merge := &v1alpha1.VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "m", Generation: generation,
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		}}
+		merge.Status.ObservedGeneration = observed
+		return merge
+	}
+
+	BeforeEach(func() {
+		tracker = &pendingTracker{since: map[string]time.Time{}}
+	})
+
+	It("starts the clock of a merge never reconciled at its creation", func() {
+		tracker.created(newMerge(time.Hour, 1, 0))
+		tracker.track(key, newMerge(time.Hour, 1, 0), false)
+		Expect(tracker.oldest()).To(BeNumerically(">=", time.Hour.Seconds()))
+	})
+
+	It("starts the clock at the generation change", func() {
+		merge := newMerge(time.Hour, 2, 1)
+		tracker.updated(newMerge(time.Hour, 1, 1), merge)
+		time.Sleep(10 * time.Millisecond)
+		// a failed reconcile does not restart the clock
+		tracker.track(key, merge, false)
+		Expect(tracker.oldest()).To(And(BeNumerically(">=", 0.01), BeNumerically("<", time.Minute.Seconds())))
+	})
+
+	It("leaves the clock of a merge whose generation did not change", func() {
+		tracker.updated(newMerge(time.Hour, 1, 1), newMerge(time.Hour, 1, 1))
+		tracker.created(newMerge(time.Hour, 1, 1))
+		Expect(tracker.oldest()).To(BeZero())
+	})
+
+	It("stops the clock once the generation is reconciled or the merge gone", func() {
+		tracker.created(newMerge(time.Hour, 1, 0))
+		tracker.track(key, newMerge(time.Hour, 1, 1), true)
+		Expect(tracker.oldest()).To(BeZero())
+
+		tracker.created(newMerge(time.Hour, 1, 0))
+		tracker.track(key, nil, false)
+		Expect(tracker.oldest()).To(BeZero())
+	})
+})
@@ -18,59 +18,110 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"sigs.k8s.io/yaml"
+	"maps"
+	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
 	"github.com/monimesl/operator-helper/oputil"
 	"github.com/monimesl/operator-helper/reconciler"
+	networkingv1alpha3 "istio.io/api/networking/v1alpha3"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
 	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 )
 
 const (
 	finalizerName = "istiomerger.monime.sl-finalizer"
+	fieldManager  = "istio-virtualservice-merger"
 )
 
-func Reconcile(ctx reconciler.Context, client versionedclient.Interface, patch *v1alpha1.VirtualServiceMerge, oldpatchref interface{}) error {
+// managedAnnotations are the annotations of the targets the operator writes, the
+// other annotations of the group such as the route ordering are set by the users
+var managedAnnotations = []string{
+	v1alpha1.OwnershipAnnotation,
+	v1alpha1.BaseAnnotation,
+	v1alpha1.RenderedAnnotation,
+	v1alpha1.CreatedAnnotation,
+}
+
+// The actions logged under the "action" key
+const (
+	actionApply  = "apply"
+	actionRemove = "remove"
+	actionDryRun = "dry-run"
+)
+
+// Options tune how the merges are written to their targets
+type Options struct {
+	// FullRender re-renders the whole target from its base spec and all of its
+	// merges instead of applying the reconciled merge incrementally
+	FullRender bool
+	// ServerSideApply writes the targets with server-side apply under a dedicated field manager
+	ServerSideApply bool
+	// ResyncPeriod is the period after which a merge is re-applied even when unchanged,
+	// so that VirtualService events missed by the controller are eventually handled
+	ResyncPeriod time.Duration
+	// DriftCheckPeriod is the period after which every target is re-rendered from its merges
+	// and fixed when it drifted from them, 0 disables the check
+	DriftCheckPeriod time.Duration
+	// DriftReportOnly reports the drifted targets without fixing them
+	DriftReportOnly bool
+}
+
+func Reconcile(ctx reconciler.Context, client versionedclient.Interface, recorder record.EventRecorder, patch *v1alpha1.VirtualServiceMerge, oldpatchref interface{}, opts Options) error {
+	log := mergeLogger(ctx, patch)
 	if oldpatchref != nil {
 		oldpatch := oldpatchref.(*v1alpha1.VirtualServiceMerge)
-		// check if target is different
-		oldTargetName, oldTargetNamespace := oldpatch.Spec.Target.Name, oldpatch.Spec.Target.Namespace
-		newTargetName, newTargetNamespace := patch.Spec.Target.Name, patch.Spec.Target.Namespace
-		if oldTargetNamespace == "" {
-			oldTargetNamespace = oldpatch.Namespace
-		}
-		if newTargetNamespace == "" {
-			newTargetNamespace = patch.Namespace
-		}
-		if oldTargetName != newTargetName || oldTargetNamespace != newTargetNamespace {
+		// check if target is different, the VirtualServices a selector is not matching anymore
+		// and the ones a host does not resolve to anymore are removed from when the merge is reconciled
+		oldTarget, applied := appliedTarget(oldpatch)
+		if applied && oldTarget != patch.Spec.Target.Reference(patch.Namespace) &&
+			(oldpatch.Spec.Target.Host == "" || patch.Spec.Target.Host == "") {
 			// remove from this object
-			ctx.Logger().Info("Virtual service target changed. Removing patch from old target", "virtualservice", oldTargetNamespace+"/"+oldTargetName)
-			if err := updateTarget(ctx, client, oldpatch, true); err != nil {
+			oldLog := mergeLogger(ctx, oldpatch).WithValues("action", actionRemove)
+			oldLog.Info("Target VirtualService changed, removing the patch from the previous target")
+			if err := updateTarget(ctx, client, recorder, oldpatch, oldTarget, true, opts); err != nil {
 				if kerr.IsNotFound(err) {
 					// ignore if virtualservice is not found
-					ctx.Logger().Info("Virtual service not found. Nothing to sync.")
+					oldLog.Info("Target VirtualService not found, nothing to sync")
 				} else {
 					return err
 				}
 			}
+			recordEvent(recorder, patch, nil, corev1.EventTypeNormal, v1alpha1.ReasonTargetChanged,
+				fmt.Sprintf("Target changed from VirtualService %s to %s",
+					oldTarget, patch.Spec.Target.String(patch.Namespace)))
 		}
 	}
 
 	if patch.DeletionTimestamp.IsZero() {
 		if !oputil.ContainsWithPrefix(patch.Finalizers, finalizerName) {
-			ctx.Logger().Info("Adding the finalizer to the patch",
-				"patch", patch.Name, "finalizer", finalizerName)
+			log.Info("Adding the finalizer to the merge", "finalizer", finalizerName)
 			patch.Finalizers = append(patch.Finalizers, finalizerName)
 			return ctx.Client().Update(context.TODO(), patch)
 		}
 	} else if oputil.Contains(patch.Finalizers, finalizerName) {
-		if err := updateTarget(ctx, client, patch, true); err != nil {
+		if patch.Spec.Target.IsSelector() {
+			if _, err := removeTargets(ctx, client, recorder, patch, patch.Status.Targets, opts); err != nil {
+				return err
+			}
+		} else if ref, applied := appliedTarget(patch); !applied {
+			log.Info("Target host never resolved, nothing to sync", "action", actionRemove)
+		} else if err := updateTarget(ctx, client, recorder, patch, ref, true, opts); err != nil {
 			if kerr.IsNotFound(err) {
 				// ignore if virtualservice is not found
-				ctx.Logger().Info("Virtual service not found. Nothing to sync.")
+				log.Info("Target VirtualService not found, nothing to sync", "action", actionRemove)
 			} else {
 				return err
 			}
@@ -81,55 +132,487 @@ func Reconcile(ctx reconciler.Context, client versionedclient.Interface, patch *
 		}
 		return nil
 	}
-	if patch.ResourceVersion != patch.Status.HandledRevision {
-		if err := updateTarget(ctx, client, patch, false); err != nil {
-			if kerr.IsNotFound(err) {
-				// ignore if virtualservice is not found
-				ctx.Logger().Info("Virtual service not found. Nothing to sync.")
-			} else {
-				return err
+	if patch.Spec.DryRun {
+		// a dry run is rendered once per generation, the resync does not apply
+		if patch.Generation == patch.Status.ObservedGeneration {
+			return nil
+		}
+		ref, err := resolveTarget(context.TODO(), ctx, patch)
+		if err == nil {
+			err = dryRun(ctx, client, patch, ref, opts)
+		}
+		if kerr.IsNotFound(err) {
+			log.Info("Target VirtualService not found, nothing to render", "action", actionDryRun)
+		}
+		if err != nil {
+			recordStatus(patch, err)
+		} else {
+			recordDryRun(patch, ref)
+			recordEvent(recorder, patch, nil, corev1.EventTypeNormal, v1alpha1.ReasonDryRun,
+				fmt.Sprintf("Patch rendered onto VirtualService %s without writing it", ref))
+		}
+		if serr := ctx.Client().Status().Update(context.TODO(), patch); serr != nil {
+			return fmt.Errorf("VirtualServiceMerge object (%s) status update error: %w", patch.Name, serr)
+		}
+		if err != nil && !kerr.IsNotFound(err) && !isUnresolved(err) && !errors.Is(err, errDryRunSelector) {
+			return err
+		}
+		return nil
+	}
+	if patch.Spec.Target.IsSelector() {
+		return reconcileSelected(ctx, client, recorder, patch, opts)
+	}
+	ref, err := resolveTarget(context.TODO(), ctx, patch)
+	if err != nil && !isUnresolved(err) {
+		return err
+	}
+	// a host resolved to another VirtualService than the one the patch is applied to, the patch
+	// moves to it. An unresolved host leaves the patch where it is until resolved again.
+	retarget := err == nil && patch.Spec.Target.Host != "" && (patch.Status.Target == nil || *patch.Status.Target != ref)
+	apply := patch.Generation != patch.Status.ObservedGeneration || resyncDue(patch, opts) || retarget
+	if !apply && err == nil {
+		// the target may have been overwritten or recreated since the patch was applied
+		if apply, err = targetDrifted(ctx, recorder, patch, ref, opts); err != nil {
+			return err
+		}
+	}
+	if apply {
+		previous := patch.Status.DeepCopy()
+		if err == nil {
+			// the target was a selector or resolved to another host before, remove the patch
+			// from the other VirtualServices it was applied to
+			stale := unselected(patch.Status.Targets, ref)
+			if retarget && patch.Status.Target != nil {
+				stale = append(stale, *patch.Status.Target)
+			}
+			targets, rerr := removeTargets(ctx, client, recorder, patch, stale, opts)
+			if rerr != nil {
+				return rerr
 			}
+			if retarget && patch.Status.Target != nil {
+				recordEvent(recorder, patch, nil, corev1.EventTypeNormal, v1alpha1.ReasonTargetChanged,
+					fmt.Sprintf("Target host moved from VirtualService %s to %s", *patch.Status.Target, ref))
+			}
+			patch.Status.Targets = targets
+			err = updateTarget(ctx, client, recorder, patch, ref, false, opts)
 		}
-		patch.Status.HandledRevision = patch.ResourceVersion
-		if err := ctx.Client().Status().Update(context.TODO(), patch); err != nil {
-			return fmt.Errorf("VirtualServiceMerge object (%s) status update error: %w", patch.Name, err)
+		if kerr.IsNotFound(err) {
+			// ignore if virtualservice is not found
+			log.Info("Target VirtualService not found, nothing to sync", "action", actionApply)
+		}
+		recordStatus(patch, err)
+		reportCondition(recorder, patch, nil, previous, v1alpha1.ConditionTargetFound, metav1.ConditionFalse, corev1.EventTypeWarning)
+		if err != nil && !kerr.IsNotFound(err) && !isUnresolved(err) {
+			recordEvent(recorder, patch, nil, corev1.EventTypeWarning, v1alpha1.ReasonUpdateFailed, err.Error())
+		}
+		if serr := ctx.Client().Status().Update(context.TODO(), patch); serr != nil {
+			return fmt.Errorf("VirtualServiceMerge object (%s) status update error: %w", patch.Name, serr)
+		}
+		if err != nil && !kerr.IsNotFound(err) && !isUnresolved(err) {
+			return err
 		}
 		return nil
 	}
 	return nil
 }
 
-func updateTarget(ctx reconciler.Context, client versionedclient.Interface, patch *v1alpha1.VirtualServiceMerge, remove bool) error {
+// mergeLogger returns the logger of the merge code paths, with the merge and its target as values
+func mergeLogger(ctx reconciler.Context, patch *v1alpha1.VirtualServiceMerge) logr.Logger {
+	return targetLogger(ctx, patch, patch.Spec.Target.String(patch.Namespace))
+}
+
+// targetLogger returns the logger of the merge writing one of its targets
+func targetLogger(ctx reconciler.Context, patch *v1alpha1.VirtualServiceMerge, target string) logr.Logger {
+	return ctx.Logger().WithValues("merge", patch.Namespace+"/"+patch.Name, "target", target)
+}
+
+// unselected returns the references other than the kept one
+func unselected(refs []v1alpha1.TargetReference, kept v1alpha1.TargetReference) []v1alpha1.TargetReference {
+	others := make([]v1alpha1.TargetReference, 0)
+	for _, ref := range refs {
+		if ref != kept {
+			others = append(others, ref)
+		}
+	}
+	return others
+}
+
+// appliedTarget returns the VirtualService the patch is applied to by its target name,
+// or by its target host once resolved. Selector merges are applied to their Status.Targets.
+func appliedTarget(patch *v1alpha1.VirtualServiceMerge) (v1alpha1.TargetReference, bool) {
+	switch {
+	case patch.Spec.Target.IsSelector():
+		return v1alpha1.TargetReference{}, false
+	case patch.Spec.Target.Host != "":
+		if patch.Status.Target == nil {
+			return v1alpha1.TargetReference{}, false
+		}
+		return *patch.Status.Target, true
+	}
+	return patch.Spec.Target.Reference(patch.Namespace), true
+}
+
+// resyncDue reports whether the merge was last applied more than a resync period ago
+func resyncDue(patch *v1alpha1.VirtualServiceMerge, opts Options) bool {
+	return opts.ResyncPeriod > 0 && time.Since(patch.Status.LastAppliedTime.Time) >= opts.ResyncPeriod
+}
+
+// recordStatus reflects the outcome of applying the patch onto its status
+func recordStatus(patch *v1alpha1.VirtualServiceMerge, err error) {
+	target := patch.Spec.Target.Reference(patch.Namespace)
+	if patch.Spec.Target.Host != "" && patch.Status.Target != nil {
+		target = *patch.Status.Target
+	}
+	var unresolved *unresolvedError
+	switch {
+	case errors.As(err, &unresolved):
+		recordUnresolved(patch, unresolved)
+	case err == nil:
+		patch.Status.ObservedGeneration = patch.Generation
+		patch.Status.HandledRevision = patch.ResourceVersion
+		patch.Status.LastAppliedTime = metav1.Now()
+		patch.Status.LastError = ""
+		patch.Status.DryRun = nil
+		patch.SetCondition(v1alpha1.ConditionTargetFound, metav1.ConditionTrue, v1alpha1.ReasonTargetFound,
+			fmt.Sprintf("VirtualService %s found", target))
+		patch.SetCondition(v1alpha1.ConditionApplied, metav1.ConditionTrue, v1alpha1.ReasonApplied,
+			fmt.Sprintf("Patch applied to VirtualService %s", target))
+		setReady(patch)
+	case kerr.IsNotFound(err):
+		// a missing target is not retried, the merge is considered handled
+		patch.Status.ObservedGeneration = patch.Generation
+		patch.Status.HandledRevision = patch.ResourceVersion
+		patch.Status.LastError = err.Error()
+		patch.Status.HttpRoutes = nil
+		patch.SetCondition(v1alpha1.ConditionTargetFound, metav1.ConditionFalse, v1alpha1.ReasonTargetNotFound,
+			fmt.Sprintf("VirtualService %s not found", target))
+		patch.SetCondition(v1alpha1.ConditionApplied, metav1.ConditionFalse, v1alpha1.ReasonTargetNotFound, "")
+		patch.SetCondition(v1alpha1.ConditionReady, metav1.ConditionFalse, v1alpha1.ReasonTargetNotFound, "")
+	default:
+		patch.Status.LastError = err.Error()
+		patch.SetCondition(v1alpha1.ConditionApplied, metav1.ConditionFalse, v1alpha1.ReasonUpdateFailed, err.Error())
+		patch.SetCondition(v1alpha1.ConditionReady, metav1.ConditionFalse, v1alpha1.ReasonUpdateFailed, "")
+	}
+}
+
+// setReady marks the applied merge ready, unless some of its routes were
+// left out because they conflict with routes of another owner
+func setReady(patch *v1alpha1.VirtualServiceMerge) {
+	if meta.IsStatusConditionTrue(patch.Status.Conditions, v1alpha1.ConditionConflicted) {
+		patch.SetCondition(v1alpha1.ConditionReady, metav1.ConditionFalse, v1alpha1.ReasonRouteConflict, "")
+	} else {
+		patch.SetCondition(v1alpha1.ConditionReady, metav1.ConditionTrue, v1alpha1.ReasonApplied, "")
+	}
+}
+
+// updateTarget applies the patch to the VirtualService, or removes it
+func updateTarget(ctx reconciler.Context, client versionedclient.Interface, recorder record.EventRecorder, patch *v1alpha1.VirtualServiceMerge, ref v1alpha1.TargetReference, remove bool, opts Options) (err error) {
 	if err := patch.Spec.Target.Validate(); err != nil {
 		return fmt.Errorf("virtualservicepatch.Reconcile: %w", err)
 	}
-	targetName, targetNamespace := patch.Spec.Target.Name, patch.Spec.Target.Namespace
-	if targetNamespace == "" {
-		targetNamespace = patch.Namespace
+	var batch []*v1alpha1.VirtualServiceMerge
+	defer func(started time.Time) {
+		recordUpdate(ref, patch, batch, remove, started, err)
+	}(time.Now())
+	// the other merges of the target waiting to be applied are written along
+	batch, err = pendingMerges(ctx, ref, patch)
+	if err != nil {
+		return err
+	}
+	touched := append(append([]*v1alpha1.VirtualServiceMerge{}, batch...), patch)
+	merges := touched
+	if remove {
+		merges = batch
+	}
+	statuses := make([]*v1alpha1.VirtualServicePatchStatus, len(touched))
+	for i, merge := range touched {
+		statuses[i] = merge.Status.DeepCopy()
 	}
-	target, err := client.NetworkingV1alpha3().VirtualServices(targetNamespace).
-		Get(context.TODO(), targetName, metav1.GetOptions{})
+	// another merge of the same target may write it in between, so re-read
+	// the target and re-apply the patch until the write is not conflicting.
+	var written *istio.VirtualService
+	var diff v1alpha1.TargetDiff
+	created := false
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		for i, merge := range touched {
+			statuses[i].DeepCopyInto(&merge.Status)
+		}
+		target, err := client.NetworkingV1alpha3().VirtualServices(ref.Namespace).
+			Get(context.TODO(), ref.Name, metav1.GetOptions{})
+		if kerr.IsNotFound(err) && !remove && createsTarget(patch, ref) {
+			target, err = client.NetworkingV1alpha3().VirtualServices(ref.Namespace).
+				Create(context.TODO(), patch.Spec.Target.NewVirtualService(ref), metav1.CreateOptions{FieldManager: fieldManager})
+			created = created || err == nil
+		}
+		if err != nil {
+			return err
+		}
+		before := target.Spec.DeepCopy()
+		annotations := maps.Clone(target.Annotations)
+		apply := mergeTarget
+		if opts.FullRender {
+			apply = renderTarget
+		}
+		conflicts, err := apply(ctx, target, patch, batch, remove)
+		if err != nil {
+			return err
+		}
+		for _, merge := range merges {
+			overlaps, err := findConflicts(ctx, merge, ref)
+			if err != nil {
+				return err
+			}
+			setConflicts(merge, append(conflicts[merge.UID], overlaps...))
+			setShadowed(merge, merge.ShadowedRoutes(target))
+		}
+		diff = v1alpha1.DiffTargets(before, &target.Spec)
+		written = target
+		if opts.FullRender && rendered(annotations, target) {
+			// the target is the one last rendered, nothing to write
+			return nil
+		}
+		err = writeTarget(client, target, opts)
+		if kerr.IsConflict(err) {
+			targetUpdateConflicts.WithLabelValues(ref.String()).Inc()
+		}
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	data, err := yaml.Marshal(target)
-	fmt.Println("orgin target ")
-	fmt.Println(string(data))
+	action := actionApply
 	if remove {
-		patch.RemoveTcpRoutes(target)
-		patch.RemoveTlsRoutes(target)
-		patch.RemoveHttpRoutes(ctx, target)
-	} else {
-		patch.AddTcpRoutes(target)
-		patch.AddTlsRoutes(target)
-		patch.AddHttpRoutes(ctx, target)
-	}
-	data1, err := yaml.Marshal(target)
-	fmt.Println("patched target ")
-	fmt.Println(string(data1))
-	if _, err = client.NetworkingV1alpha3().VirtualServices(targetNamespace).
-		Update(context.TODO(), target, metav1.UpdateOptions{}); err != nil {
+		action = actionRemove
+	}
+	log := targetLogger(ctx, patch, ref.String()).WithValues("action", action)
+	if created {
+		log.Info("Target VirtualService created from the template")
+		recordEvent(recorder, patch, written, corev1.EventTypeNormal, v1alpha1.ReasonTargetCreated,
+			fmt.Sprintf("VirtualService %s created from the target template", ref))
+	}
+	log.Info("Target VirtualService updated", "routeCount", len(written.Spec.Http)+len(written.Spec.Tcp)+len(written.Spec.Tls),
+		"batched", len(batch), "added", diff.Added, "replaced", diff.Replaced, "removed", diff.Removed, "reordered", diff.Reordered)
+	if !diff.Empty() {
+		recorder.Event(written, corev1.EventTypeNormal, v1alpha1.ReasonTargetUpdated, diff.String())
+	}
+	if remove {
+		recordEvent(recorder, patch, written, corev1.EventTypeNormal, v1alpha1.ReasonRemoved,
+			fmt.Sprintf("Patch removed from VirtualService %s", ref))
+		if v1alpha1.IsCreated(written) {
+			if err := deleteUnused(ctx, client, recorder, patch, written); err != nil {
+				return err
+			}
+		}
+	}
+	for i, merge := range merges {
+		merge.Status.Target = &ref
+		// a merge re-applied by the resync is left out
+		if merge.Generation != merge.Status.ObservedGeneration {
+			recordEvent(recorder, merge, written, corev1.EventTypeNormal, v1alpha1.ReasonApplied,
+				fmt.Sprintf("Patch applied to VirtualService %s", ref))
+		}
+		reportCondition(recorder, merge, written, statuses[i], v1alpha1.ConditionConflicted, metav1.ConditionTrue, corev1.EventTypeWarning)
+		reportCondition(recorder, merge, nil, statuses[i], v1alpha1.ConditionShadowed, metav1.ConditionTrue, corev1.EventTypeWarning)
+	}
+	for _, merge := range batch {
+		recordStatus(merge, nil)
+		if err := ctx.Client().Status().Update(context.TODO(), merge); err != nil {
+			// the merge reconciles itself again when its status is not updated
+			log.Error(err, "Batched VirtualServiceMerge status update error", "batchedMerge", merge.Namespace+"/"+merge.Name)
+		}
+	}
+	return nil
+}
+
+// rendered reports whether the target is rendered exactly as it was last written, given the
+// annotations it was read with: the hash of its spec, its base and its ledger are unchanged
+func rendered(annotations map[string]string, target *istio.VirtualService) bool {
+	if annotations[v1alpha1.RenderedAnnotation] != v1alpha1.SpecHash(&target.Spec) {
+		return false
+	}
+	for _, key := range []string{v1alpha1.RenderedAnnotation, v1alpha1.BaseAnnotation, v1alpha1.OwnershipAnnotation} {
+		if annotations[key] != target.Annotations[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// createsTarget reports whether the merge creates the VirtualService when missing
+func createsTarget(patch *v1alpha1.VirtualServiceMerge, ref v1alpha1.TargetReference) bool {
+	return patch.Spec.Target.CreateIfMissing && patch.Spec.Target.Reference(patch.Namespace) == ref
+}
+
+// deleteUnused deletes the VirtualService created from a template once no other merge targets it
+func deleteUnused(ctx reconciler.Context, client versionedclient.Interface, recorder record.EventRecorder, patch *v1alpha1.VirtualServiceMerge, target *istio.VirtualService) error {
+	ref := v1alpha1.TargetReference{Name: target.Name, Namespace: target.Namespace}
+	merges, err := listMerges(context.TODO(), ctx, ref)
+	if err != nil {
+		return err
+	}
+	for i := range merges.Items {
+		if merge := &merges.Items[i]; merge.UID != patch.UID && merge.DeletionTimestamp.IsZero() {
+			return nil
+		}
+	}
+	uid := target.UID
+	err = client.NetworkingV1alpha3().VirtualServices(ref.Namespace).
+		Delete(context.TODO(), ref.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+	if kerr.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
+	targetLogger(ctx, patch, ref.String()).Info("Target VirtualService created from the template deleted", "action", actionRemove)
+	recordEvent(recorder, patch, nil, corev1.EventTypeNormal, v1alpha1.ReasonTargetDeleted,
+		fmt.Sprintf("VirtualService %s created from the target template deleted, no other merge targets it", ref))
 	return nil
 }
+
+// setConflicts reflects the routes of the merge conflicting with other routes of the target
+func setConflicts(merge *v1alpha1.VirtualServiceMerge, conflicts []string) {
+	if len(conflicts) > 0 {
+		merge.SetCondition(v1alpha1.ConditionConflicted, metav1.ConditionTrue, v1alpha1.ReasonRouteConflict,
+			fmt.Sprintf("Routes conflicting with other routes of the target: %s", strings.Join(conflicts, ", ")))
+	} else {
+		merge.SetCondition(v1alpha1.ConditionConflicted, metav1.ConditionFalse, v1alpha1.ReasonNoRouteConflict, "")
+	}
+}
+
+// setShadowed reflects the routes of the merge which can never be reached in the target
+func setShadowed(merge *v1alpha1.VirtualServiceMerge, shadowed []string) {
+	if len(shadowed) > 0 {
+		merge.SetCondition(v1alpha1.ConditionShadowed, metav1.ConditionTrue, v1alpha1.ReasonRouteShadowed,
+			fmt.Sprintf("Routes never reached because of earlier routes of the target: %s", strings.Join(shadowed, ", ")))
+	} else {
+		merge.SetCondition(v1alpha1.ConditionShadowed, metav1.ConditionFalse, v1alpha1.ReasonNoRouteShadowed, "")
+	}
+}
+
+// pendingMerges returns the other merges of the target whose current generation is not applied yet
+func pendingMerges(ctx reconciler.Context, ref v1alpha1.TargetReference, patch *v1alpha1.VirtualServiceMerge) ([]*v1alpha1.VirtualServiceMerge, error) {
+	list, err := listMerges(context.TODO(), ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	merges := make([]*v1alpha1.VirtualServiceMerge, 0)
+	for i := range list.Items {
+		merge := &list.Items[i]
+		// merges resolving their targets by selector or host apply themselves to them
+		if merge.UID == patch.UID || !merge.DeletionTimestamp.IsZero() || merge.Spec.DryRun || merge.Spec.Target.Name == "" ||
+			// merges without the finalizer yet would not be removed from the target on delete
+			!oputil.Contains(merge.Finalizers, finalizerName) ||
+			merge.Generation == merge.Status.ObservedGeneration {
+			continue
+		}
+		merges = append(merges, merge)
+	}
+	return merges, nil
+}
+
+// writeTarget writes the merged target with an update, or with a server-side apply
+// of the spec and of the annotations of the operator when enabled. Both are
+// guarded by the resourceVersion of the target.
+func writeTarget(client versionedclient.Interface, target *istio.VirtualService, opts Options) error {
+	if !opts.ServerSideApply {
+		_, err := client.NetworkingV1alpha3().VirtualServices(target.Namespace).
+			Update(context.TODO(), target, metav1.UpdateOptions{FieldManager: fieldManager})
+		return err
+	}
+	applied := &istio.VirtualService{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: istio.SchemeGroupVersion.String(),
+			Kind:       "VirtualService",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            target.Name,
+			Namespace:       target.Namespace,
+			ResourceVersion: target.ResourceVersion,
+			Annotations:     map[string]string{},
+		},
+	}
+	for _, key := range managedAnnotations {
+		if value, ok := target.Annotations[key]; ok {
+			applied.Annotations[key] = value
+		}
+	}
+	target.Spec.DeepCopyInto(&applied.Spec)
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = client.NetworkingV1alpha3().VirtualServices(target.Namespace).
+		Patch(context.TODO(), target.Name, types.ApplyPatchType, data,
+			metav1.PatchOptions{FieldManager: fieldManager, Force: &force})
+	return err
+}
+
+// mergeTarget applies the patch and the batched merges onto the current spec of the target.
+// It returns the routes of each merge that could not be merged.
+func mergeTarget(ctx reconciler.Context, target *istio.VirtualService, patch *v1alpha1.VirtualServiceMerge, batch []*v1alpha1.VirtualServiceMerge, remove bool) (map[types.UID][]string, error) {
+	ledger, err := v1alpha1.ReadLedger(target)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := map[types.UID][]string{}
+	if remove {
+		patch.RemoveTcpRoutes(target, ledger)
+		patch.RemoveTlsRoutes(target, ledger)
+		patch.RemoveHttpRoutes(ctx.Logger(), target, ledger)
+		patch.RemoveListFields(target, ledger)
+	} else {
+		batch = append(batch, patch)
+	}
+	for _, merge := range batch {
+		protected := merge.AddTcpRoutes(target, ledger)
+		protected = append(protected, merge.AddTlsRoutes(target, ledger)...)
+		conflicts[merge.UID] = append(protected, merge.AddHttpRoutes(ctx.Logger(), target, ledger)...)
+		merge.AddListFields(target, ledger)
+		logMerged(ctx, merge, conflicts[merge.UID])
+	}
+	return conflicts, ledger.Write(target)
+}
+
+// logMerged logs at debug level the routes the merge contributed to its target
+func logMerged(ctx reconciler.Context, merge *v1alpha1.VirtualServiceMerge, protected []string) {
+	mergeLogger(ctx, merge).V(1).Info("Patch merged", "action", actionApply,
+		"routeCount", len(merge.Status.HttpRoutes)+len(merge.Status.TcpRoutes)+len(merge.Status.TlsRoutes),
+		"httpRoutes", merge.Status.HttpRoutes, "protected", protected)
+}
+
+// findConflicts returns the tls routes of the patch overlapping the tls
+// routes of another VirtualServiceMerge targeting the same VirtualService.
+// Routes colliding by identity are reported when merged, see OwnershipLedger.
+func findConflicts(ctx reconciler.Context, patch *v1alpha1.VirtualServiceMerge, ref v1alpha1.TargetReference) ([]string, error) {
+	merges, err := listMerges(context.TODO(), ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := make([]string, 0)
+	for i := range merges.Items {
+		other := &merges.Items[i]
+		if other.UID == patch.UID {
+			continue
+		}
+		refs, otherRefs := patch.TlsRouteRefs(), other.TlsRouteRefs()
+		for j, route := range patch.Spec.Patch.Tls {
+			for k, otherRoute := range other.Spec.Patch.Tls {
+				// identical matches are the same route, settled by ownership
+				if refs[j].Match != otherRefs[k].Match && v1alpha1.TlsMatchesOverlap(route.Match, otherRoute.Match) {
+					conflicts = append(conflicts, fmt.Sprintf("tls %s (%s/%s)", tlsHosts(route), other.Namespace, other.Name))
+				}
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+func tlsHosts(route *networkingv1alpha3.TLSRoute) string {
+	hosts := make([]string, 0)
+	for _, m := range route.Match {
+		hosts = append(hosts, m.SniHosts...)
+	}
+	return strings.Join(hosts, ",")
+}
@@ -0,0 +1,466 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/mock/gomock"
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/istio-virtualservice-merger/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	networkingv1alpha3 "istio.io/api/networking/v1alpha3"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	istiofake "istio.io/client-go/pkg/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Reconcile", func() {
+	const host = "reviews.example.com"
+	var (
+		rctx        *mocks.MockContext
+		istioClient *istiofake.Clientset
+		recorder    *record.FakeRecorder
+	)
+
+	// newBase returns a VirtualService with a base route
+	newBase := func(name string) *istio.VirtualService {
+		target := &istio.VirtualService{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+		target.Spec.Hosts = []string{host}
+		target.Spec.Http = []*networkingv1alpha3.HTTPRoute{{
+			Name:  "default",
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: "reviews"}}},
+		}}
+		return target
+	}
+	// newTarget returns a VirtualService with a base route and the route merged by the merge
+	newTarget := func(name string, merge *v1alpha1.VirtualServiceMerge) *istio.VirtualService {
+		target := newBase(name)
+		ledger := v1alpha1.OwnershipLedger{}
+		Expect(merge.AddHttpRoutes(logr.Discard(), target, ledger)).To(BeEmpty())
+		Expect(ledger.Write(target)).To(Succeed())
+		return target
+	}
+	newMerge := func(target v1alpha1.Target) *v1alpha1.VirtualServiceMerge {
+		merge := &v1alpha1.VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "m", UID: "m-uid", Finalizers: []string{finalizerName},
+		}}
+		merge.Spec.Target = target
+		merge.Spec.Patch.Http = []*networkingv1alpha3.HTTPRoute{{
+			Name:  "reviews-v2-1",
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: "reviews-v2"}}},
+		}}
+		return merge
+	}
+	// setup stores the merge and the VirtualServices, and returns the stored merge
+	setup := func(merge *v1alpha1.VirtualServiceMerge, targets ...*istio.VirtualService) *v1alpha1.VirtualServiceMerge {
+		rctx = newTestContext(merge)
+		istioClient = istiofake.NewSimpleClientset()
+		for _, target := range targets {
+			_, err := istioClient.NetworkingV1alpha3().VirtualServices(target.Namespace).Create(context.TODO(), target, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		recorder = record.NewFakeRecorder(100)
+		stored := &v1alpha1.VirtualServiceMerge{}
+		Expect(rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), stored)).To(Succeed())
+		return stored
+	}
+	// stored returns the status of the merge as stored
+	stored := func(merge *v1alpha1.VirtualServiceMerge) v1alpha1.VirtualServicePatchStatus {
+		current := &v1alpha1.VirtualServiceMerge{}
+		Expect(rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), current)).To(Succeed())
+		return current.Status
+	}
+	// condition returns the status and the reason of the condition, empty when not set
+	condition := func(status v1alpha1.VirtualServicePatchStatus, conditionType string) string {
+		if c := meta.FindStatusCondition(status.Conditions, conditionType); c != nil {
+			return string(c.Status) + "/" + c.Reason
+		}
+		return ""
+	}
+	// events returns the events recorded since the last call
+	events := func() []string {
+		recorded := make([]string, 0)
+		for len(recorder.Events) > 0 {
+			recorded = append(recorded, <-recorder.Events)
+		}
+		return recorded
+	}
+	routeNames := func(name string) []string {
+		target, err := istioClient.NetworkingV1alpha3().VirtualServices("default").Get(context.TODO(), name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		names := make([]string, 0)
+		for _, route := range target.Spec.Http {
+			names = append(names, route.Name)
+		}
+		return names
+	}
+
+	It("reports the target and the routes of an applied merge in its status", func() {
+		merge := newMerge(v1alpha1.Target{Name: "reviews"})
+		merge.Generation = 1
+		merge = setup(merge, newBase("reviews"))
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		Expect(routeNames("reviews")).To(Equal([]string{"reviews-v2-1", "default"}))
+		status := stored(merge)
+		Expect(status.ObservedGeneration).To(BeEquivalentTo(1))
+		Expect(status.Target).To(Equal(&v1alpha1.TargetReference{Namespace: "default", Name: "reviews"}))
+		Expect(status.HttpRoutes).To(Equal([]string{"reviews-v2-1"}))
+		Expect(status.LastError).To(BeEmpty())
+		Expect(condition(status, v1alpha1.ConditionReady)).To(Equal("True/Applied"))
+		Expect(condition(status, v1alpha1.ConditionTargetFound)).To(Equal("True/TargetFound"))
+		Expect(condition(status, v1alpha1.ConditionApplied)).To(Equal("True/Applied"))
+		Expect(condition(status, v1alpha1.ConditionConflicted)).To(Equal("False/NoRouteConflict"))
+	})
+
+	It("reports a missing target in the status of the merge", func() {
+		merge := newMerge(v1alpha1.Target{Name: "reviews"})
+		merge.Generation = 1
+		merge = setup(merge)
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		status := stored(merge)
+		Expect(status.ObservedGeneration).To(BeEquivalentTo(1))
+		Expect(status.HttpRoutes).To(BeEmpty())
+		Expect(status.LastError).NotTo(BeEmpty())
+		Expect(condition(status, v1alpha1.ConditionReady)).To(Equal("False/TargetNotFound"))
+		Expect(condition(status, v1alpha1.ConditionTargetFound)).To(Equal("False/TargetNotFound"))
+		Expect(condition(status, v1alpha1.ConditionApplied)).To(Equal("False/TargetNotFound"))
+	})
+
+	It("reports the routes conflicting with the routes of another merge in the status of the merge", func() {
+		other := newMerge(v1alpha1.Target{Name: "reviews"})
+		other.Name, other.UID = "other", "other-uid"
+		merge := newMerge(v1alpha1.Target{Name: "reviews"})
+		merge.Generation = 1
+		merge = setup(merge, newTarget("reviews", other))
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		Expect(routeNames("reviews")).To(Equal([]string{"reviews-v2-1", "default"}))
+		status := stored(merge)
+		Expect(status.Target).To(Equal(&v1alpha1.TargetReference{Namespace: "default", Name: "reviews"}))
+		Expect(status.HttpRoutes).To(BeEmpty())
+		Expect(condition(status, v1alpha1.ConditionReady)).To(Equal("False/RouteConflict"))
+		Expect(condition(status, v1alpha1.ConditionTargetFound)).To(Equal("True/TargetFound"))
+		Expect(condition(status, v1alpha1.ConditionConflicted)).To(Equal("True/RouteConflict"))
+		Expect(meta.FindStatusCondition(status.Conditions, v1alpha1.ConditionConflicted).Message).To(ContainSubstring("default/other"))
+	})
+
+	It("renders a merge in dry run into its status without writing the target", func() {
+		other := newMerge(v1alpha1.Target{Name: "reviews"})
+		other.Name, other.UID = "other", "other-uid"
+		merge := newMerge(v1alpha1.Target{Name: "reviews"})
+		merge.Generation = 1
+		merge.Spec.DryRun = true
+		merge.Spec.Patch.Http = append(merge.Spec.Patch.Http, &networkingv1alpha3.HTTPRoute{
+			Name:  "ratings-1",
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: "ratings"}}},
+		})
+		merge = setup(merge, newTarget("reviews", other))
+		istioClient.ClearActions()
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		for _, action := range istioClient.Actions() {
+			Expect(action.GetVerb()).To(Equal("get"), "the target is only read")
+		}
+		target, err := istioClient.NetworkingV1alpha3().VirtualServices("default").Get(context.TODO(), "reviews", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		ledger, err := v1alpha1.ReadLedger(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ledger).To(HaveLen(1))
+		Expect(ledger).To(HaveKeyWithValue("http/reviews-v2-1", HaveField("UID", other.UID)))
+		status := stored(merge)
+		Expect(status.DryRun).NotTo(BeNil())
+		Expect(status.DryRun.Generation).To(BeEquivalentTo(1))
+		Expect(status.DryRun.TargetRevision).To(Equal(target.ResourceVersion))
+		Expect(status.DryRun.Rendered).To(ContainSubstring("ratings-1"))
+		Expect(status.DryRun.Diff).To(ContainSubstring("ratings-1"))
+		Expect(status.HttpRoutes).To(BeEmpty())
+		Expect(condition(status, v1alpha1.ConditionConflicted)).To(Equal("True/RouteConflict"))
+		Expect(meta.FindStatusCondition(status.Conditions, v1alpha1.ConditionConflicted).Message).To(ContainSubstring("default/other"))
+		Expect(condition(status, v1alpha1.ConditionReady)).To(Equal("False/DryRun"))
+	})
+
+	It("re-applies a reconciled merge whose routes were overwritten in its target", func() {
+		merge := newMerge(v1alpha1.Target{Name: "reviews"})
+		merge.Generation, merge.Status.ObservedGeneration = 1, 1
+		merge.Status.LastAppliedTime = metav1.Now()
+		// the base VirtualService re-applied over the merged one
+		edited := newBase("reviews")
+		merge = setup(merge, edited)
+		Expect(rctx.Client().Create(context.TODO(), edited.DeepCopy())).To(Succeed())
+		drifts := testutil.ToFloat64(targetDrifts.WithLabelValues("default/reviews"))
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		Expect(routeNames("reviews")).To(Equal([]string{"reviews-v2-1", "default"}))
+		Expect(events()).To(ContainElement(ContainSubstring(v1alpha1.ReasonDrifted)))
+		Expect(testutil.ToFloat64(targetDrifts.WithLabelValues("default/reviews"))).To(Equal(drifts + 1))
+	})
+
+	It("leaves a reconciled merge whose routes are in its target", func() {
+		merge := newMerge(v1alpha1.Target{Name: "reviews"})
+		merge.Generation, merge.Status.ObservedGeneration = 1, 1
+		merge.Status.LastAppliedTime = metav1.Now()
+		target := newTarget("reviews", merge)
+		merge = setup(merge, target)
+		Expect(rctx.Client().Create(context.TODO(), target.DeepCopy())).To(Succeed())
+		istioClient.ClearActions()
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		Expect(istioClient.Actions()).To(BeEmpty())
+		Expect(events()).To(BeEmpty())
+	})
+
+	It("adopts the routes a merge wrote to its target before the ownership ledger existed", func() {
+		merge := newMerge(v1alpha1.Target{Name: "reviews"})
+		merge.Generation = 1
+		// the status and the target as left by a release of the operator without the ledger
+		merge.Status.HandledRevision = "1"
+		target := newBase("reviews")
+		target.Spec.Http = append(merge.Spec.Patch.Http[0:1:1], target.Spec.Http...)
+		merge.Spec.Patch.Http = []*networkingv1alpha3.HTTPRoute{{
+			Name:  "reviews-v2-1",
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: "reviews-v3"}}},
+		}}
+		merge = setup(merge, target)
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		written, err := istioClient.NetworkingV1alpha3().VirtualServices("default").Get(context.TODO(), "reviews", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written.Spec.Http).To(HaveLen(2))
+		Expect(written.Spec.Http[0].Route[0].Destination.Host).To(Equal("reviews-v3"))
+		ledger, err := v1alpha1.ReadLedger(written)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ledger).To(HaveKeyWithValue("http/reviews-v2-1", HaveField("UID", merge.UID)))
+		status := stored(merge)
+		Expect(status.HttpRoutes).To(Equal([]string{"reviews-v2-1"}))
+		Expect(condition(status, v1alpha1.ConditionConflicted)).To(Equal("False/NoRouteConflict"))
+	})
+
+	Context("with a target created when missing", func() {
+		createIfMissing := v1alpha1.Target{Name: "reviews", CreateIfMissing: true, Template: &v1alpha1.TargetTemplate{
+			Hosts:        []string{host},
+			DefaultRoute: newBase("reviews").Spec.Http[0],
+		}}
+		// created returns the target as created from the template with the route of the merge
+		created := func(merge *v1alpha1.VirtualServiceMerge) *istio.VirtualService {
+			target := newTarget("reviews", merge)
+			target.Annotations[v1alpha1.CreatedAnnotation] = "true"
+			return target
+		}
+		// deleted returns the merge being deleted after it was applied
+		deleted := func() *v1alpha1.VirtualServiceMerge {
+			merge := newMerge(createIfMissing)
+			merge.Status.Target = &v1alpha1.TargetReference{Namespace: "default", Name: "reviews"}
+			merge.DeletionTimestamp = &metav1.Time{Time: metav1.Now().Time}
+			return merge
+		}
+
+		It("creates the target from the template", func() {
+			merge := newMerge(createIfMissing)
+			merge.Generation = 1
+			merge = setup(merge)
+
+			Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+			target, err := istioClient.NetworkingV1alpha3().VirtualServices("default").Get(context.TODO(), "reviews", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v1alpha1.IsCreated(target)).To(BeTrue())
+			Expect(target.Spec.Hosts).To(Equal([]string{host}))
+			Expect(routeNames("reviews")).To(Equal([]string{"reviews-v2-1", "default"}))
+			Expect(events()).To(ContainElement(ContainSubstring(v1alpha1.ReasonTargetCreated)))
+			Expect(condition(stored(merge), v1alpha1.ConditionReady)).To(Equal("True/Applied"))
+		})
+
+		It("keeps the created target while another merge references it", func() {
+			merge := deleted()
+			merge = setup(merge, created(merge))
+			other := newMerge(v1alpha1.Target{Name: "reviews"})
+			other.Name, other.UID = "other", "other-uid"
+			Expect(rctx.Client().Create(context.TODO(), other)).To(Succeed())
+
+			Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+			Expect(routeNames("reviews")).To(Equal([]string{"default"}))
+			Expect(events()).NotTo(ContainElement(ContainSubstring(v1alpha1.ReasonTargetDeleted)))
+		})
+
+		It("deletes the created target when the last merge referencing it is removed", func() {
+			merge := deleted()
+			merge = setup(merge, created(merge))
+
+			Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+			_, err := istioClient.NetworkingV1alpha3().VirtualServices("default").Get(context.TODO(), "reviews", metav1.GetOptions{})
+			Expect(kerr.IsNotFound(err)).To(BeTrue(), "the target is deleted")
+			Expect(events()).To(ContainElement(ContainSubstring(v1alpha1.ReasonTargetDeleted)))
+			err = rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), &v1alpha1.VirtualServiceMerge{})
+			Expect(kerr.IsNotFound(err)).To(BeTrue(), "the finalizer is removed")
+		})
+	})
+
+	It("removes a deleted host merge from the VirtualService its host resolved to", func() {
+		merge := newMerge(v1alpha1.Target{Host: host})
+		merge.Status.Target = &v1alpha1.TargetReference{Namespace: "default", Name: "reviews"}
+		merge.DeletionTimestamp = &metav1.Time{Time: metav1.Now().Time}
+		merge = setup(merge, newTarget("reviews", merge))
+		Expect(routeNames("reviews")).To(Equal([]string{"reviews-v2-1", "default"}))
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		Expect(routeNames("reviews")).To(Equal([]string{"default"}))
+		err := rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), &v1alpha1.VirtualServiceMerge{})
+		Expect(kerr.IsNotFound(err)).To(BeTrue(), "the finalizer is removed")
+	})
+
+	It("removes a deleted host merge never resolved without touching any VirtualService", func() {
+		merge := newMerge(v1alpha1.Target{Host: host})
+		merge.DeletionTimestamp = &metav1.Time{Time: metav1.Now().Time}
+		merge = setup(merge)
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, Options{})).To(Succeed())
+		err := rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), &v1alpha1.VirtualServiceMerge{})
+		Expect(kerr.IsNotFound(err)).To(BeTrue(), "the finalizer is removed")
+	})
+
+	It("removes a merge switched from a host to a name from the VirtualService its host resolved to", func() {
+		oldMerge := newMerge(v1alpha1.Target{Host: host})
+		oldMerge.Status.Target = &v1alpha1.TargetReference{Namespace: "default", Name: "reviews"}
+		merge := oldMerge.DeepCopy()
+		merge.Spec.Target = v1alpha1.Target{Name: "other"}
+		// the finalizer is added back after the removal to end the reconcile there
+		merge.Finalizers = nil
+		merge = setup(merge, newTarget("reviews", oldMerge))
+
+		Expect(Reconcile(rctx, istioClient, recorder, merge, oldMerge, Options{})).To(Succeed())
+		Expect(routeNames("reviews")).To(Equal([]string{"default"}))
+	})
+})
+
+// newTestContext returns a reconciler context whose client holds the merges indexed by target,
+// along with the namespaces and the VirtualServices among the objects
+func newTestContext(objects ...client.Object) *mocks.MockContext {
+	scheme := runtime.NewScheme()
+	Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+	Expect(corev1.AddToScheme(scheme)).To(Succeed())
+	Expect(istio.AddToScheme(scheme)).To(Succeed())
+	kclient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithStatusSubresource(&v1alpha1.VirtualServiceMerge{}).
+		WithIndex(&v1alpha1.VirtualServiceMerge{}, targetIndexField, indexTarget).
+		WithObjects(objects...).
+		Build()
+	rctx := mocks.NewMockContext(gomock.NewController(GinkgoT()))
+	rctx.EXPECT().Client().Return(kclient).AnyTimes()
+	rctx.EXPECT().Logger().Return(logr.Discard()).AnyTimes()
+	return rctx
+}
+
+var _ = Describe("updateTarget", func() {
+	ref := v1alpha1.TargetReference{Namespace: "default", Name: "reviews"}
+	var (
+		rctx        *mocks.MockContext
+		istioClient *istiofake.Clientset
+		recorder    *record.FakeRecorder
+		merge       *v1alpha1.VirtualServiceMerge
+		target      *istio.VirtualService
+	)
+
+	route := func(name, dest string) *networkingv1alpha3.HTTPRoute {
+		return &networkingv1alpha3.HTTPRoute{
+			Name:  name,
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: dest}}},
+		}
+	}
+	routeNames := func(routes []*networkingv1alpha3.HTTPRoute) []string {
+		names := make([]string, len(routes))
+		for i, r := range routes {
+			names[i] = r.Name
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		merge = &v1alpha1.VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "m", UID: "m-uid", Generation: 1, Finalizers: []string{finalizerName},
+		}}
+		merge.Spec.Target.Name = ref.Name
+		merge.Spec.Patch.Http = []*networkingv1alpha3.HTTPRoute{route("reviews-v2-1", "reviews-v2")}
+		target = &istio.VirtualService{ObjectMeta: metav1.ObjectMeta{
+			Namespace: ref.Namespace, Name: ref.Name,
+			Annotations: map[string]string{
+				v1alpha1.RouteOrderingAnnotation: v1alpha1.OrderBySpecificity,
+				"team":                           "reviews",
+			},
+		}}
+		target.Spec.Http = []*networkingv1alpha3.HTTPRoute{route("default", "reviews")}
+		rctx = newTestContext(merge)
+		istioClient = istiofake.NewSimpleClientset(target)
+		recorder = record.NewFakeRecorder(100)
+	})
+
+	It("applies the spec and only the annotations of the operator with server-side apply", func() {
+		var applied *istio.VirtualService
+		istioClient.PrependReactor("patch", "virtualservices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			patch := action.(k8stesting.PatchAction)
+			Expect(patch.GetPatchType()).To(Equal(types.ApplyPatchType))
+			applied = &istio.VirtualService{}
+			Expect(json.Unmarshal(patch.GetPatch(), applied)).To(Succeed())
+			return true, applied, nil
+		})
+
+		Expect(updateTarget(rctx, istioClient, recorder, merge, ref, false, Options{ServerSideApply: true})).To(Succeed())
+		Expect(applied).NotTo(BeNil())
+		Expect(routeNames(applied.Spec.Http)).To(Equal([]string{"reviews-v2-1", "default"}))
+		Expect(applied.Annotations).To(HaveKey(v1alpha1.OwnershipAnnotation))
+		Expect(applied.Annotations).NotTo(HaveKey(v1alpha1.RouteOrderingAnnotation))
+		Expect(applied.Annotations).NotTo(HaveKey("team"))
+	})
+
+	It("re-applies the patch onto the target written in between when the update conflicts", func() {
+		conflicts := testutil.ToFloat64(targetUpdateConflicts.WithLabelValues(ref.String()))
+		updates := 0
+		istioClient.PrependReactor("update", "virtualservices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if updates++; updates > 1 {
+				return false, nil, nil
+			}
+			// another merge writes the target in between
+			written := target.DeepCopy()
+			written.Spec.Http = append([]*networkingv1alpha3.HTTPRoute{route("other-1", "reviews-v3")}, written.Spec.Http...)
+			Expect(istioClient.Tracker().Update(istio.SchemeGroupVersion.WithResource("virtualservices"), written, ref.Namespace)).To(Succeed())
+			return true, nil, kerr.NewConflict(istio.SchemeGroupVersion.WithResource("virtualservices").GroupResource(), ref.Name, errors.New("modified"))
+		})
+
+		Expect(updateTarget(rctx, istioClient, recorder, merge, ref, false, Options{})).To(Succeed())
+		Expect(updates).To(Equal(2))
+		written, err := istioClient.NetworkingV1alpha3().VirtualServices(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routeNames(written.Spec.Http)).To(Equal([]string{"reviews-v2-1", "other-1", "default"}))
+		Expect(testutil.ToFloat64(targetUpdateConflicts.WithLabelValues(ref.String()))).To(Equal(conflicts + 1))
+	})
+})
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/operator-helper/reconciler"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// renderTarget recomputes the whole spec of the target from its base spec and every
+// VirtualServiceMerge targeting it, so the result does not depend on the order the
+// merges were reconciled in. The patch is left out when it is being removed.
+// It returns the routes of each merge that could not be merged.
+func renderTarget(ctx reconciler.Context, target *istio.VirtualService, patch *v1alpha1.VirtualServiceMerge, batch []*v1alpha1.VirtualServiceMerge, remove bool) (map[types.UID][]string, error) {
+	merges, err := targetMerges(ctx, target, patch, batch, remove)
+	if err != nil {
+		return nil, err
+	}
+	var removed *v1alpha1.VirtualServiceMerge
+	if remove {
+		removed = patch
+	}
+	conflicts, err := render(ctx, target, merges, removed)
+	if remove {
+		patch.Status.HttpRoutes, patch.Status.TcpRoutes, patch.Status.TlsRoutes = nil, nil, nil
+		patch.Status.Hosts, patch.Status.Gateways, patch.Status.ExportTo = nil, nil, nil
+	}
+	return conflicts, err
+}
+
+// render recomputes the spec of the target from its base spec and the merges, in their order.
+// The removed merge, if any, is only left out of the base.
+func render(ctx reconciler.Context, target *istio.VirtualService, merges []*v1alpha1.VirtualServiceMerge, removed *v1alpha1.VirtualServiceMerge) (map[types.UID][]string, error) {
+	ledger, err := v1alpha1.ReadLedger(target)
+	if err != nil {
+		return nil, err
+	}
+	base, err := v1alpha1.ReadBase(target)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		// first render or the target was edited since, rebase on its unmanaged routes. The
+		// routes the merges wrote before the ledger existed are not part of the base either.
+		for _, merge := range merges {
+			ledger.Adopt(merge)
+		}
+		if removed != nil {
+			ledger.Adopt(removed)
+		}
+		base = ledger.Unmanaged(&target.Spec)
+	}
+	base.DeepCopyInto(&target.Spec)
+	ledger = v1alpha1.OwnershipLedger{}
+	conflicts := map[types.UID][]string{}
+	for _, merge := range merges {
+		// the base holds none of the merged routes, nothing is left from previous merges
+		merge.Status.HttpRoutes, merge.Status.TcpRoutes, merge.Status.TlsRoutes = nil, nil, nil
+		protected := merge.AddTcpRoutes(target, ledger)
+		protected = append(protected, merge.AddTlsRoutes(target, ledger)...)
+		conflicts[merge.UID] = append(protected, merge.AddHttpRoutes(ctx.Logger(), target, ledger)...)
+		merge.AddListFields(target, ledger)
+		logMerged(ctx, merge, conflicts[merge.UID])
+	}
+	if err = ledger.Write(target); err != nil {
+		return nil, err
+	}
+	return conflicts, v1alpha1.WriteBase(target, base)
+}
+
+// targetMerges returns the live merges targeting the VirtualService sorted by namespace and name,
+// with the patch and the batched merges standing for their own listed copies.
+func targetMerges(ctx reconciler.Context, target *istio.VirtualService, patch *v1alpha1.VirtualServiceMerge, batch []*v1alpha1.VirtualServiceMerge, remove bool) ([]*v1alpha1.VirtualServiceMerge, error) {
+	list, err := listMerges(context.TODO(), ctx, v1alpha1.TargetReference{Name: target.Name, Namespace: target.Namespace})
+	if err != nil {
+		return nil, err
+	}
+	batched := map[types.UID]*v1alpha1.VirtualServiceMerge{}
+	for _, merge := range batch {
+		batched[merge.UID] = merge
+	}
+	merges := make([]*v1alpha1.VirtualServiceMerge, 0)
+	for i := range list.Items {
+		merge := &list.Items[i]
+		if m, ok := batched[merge.UID]; ok {
+			merge = m
+		}
+		// merges in dry run are left out of the target, as well as the selectors not matching it
+		// anymore which are removed from it when reconciled
+		if merge.UID == patch.UID || !merge.DeletionTimestamp.IsZero() || merge.Spec.DryRun ||
+			!merge.Spec.Target.Matches(merge.Namespace, target) {
+			continue
+		}
+		merges = append(merges, merge)
+	}
+	if !remove {
+		merges = append(merges, patch)
+	}
+	sortMerges(merges)
+	return merges, nil
+}
+
+func sortMerges(merges []*v1alpha1.VirtualServiceMerge) {
+	sort.Slice(merges, func(i, j int) bool {
+		if merges[i].Namespace != merges[j].Namespace {
+			return merges[i].Namespace < merges[j].Namespace
+		}
+		return merges[i].Name < merges[j].Name
+	})
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/istio-virtualservice-merger/tests/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	networkingv1alpha3 "istio.io/api/networking/v1alpha3"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	istiofake "istio.io/client-go/pkg/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Full render", func() {
+	// the resync re-applies the merge without a new generation
+	opts := Options{FullRender: true, ResyncPeriod: time.Nanosecond}
+	var (
+		rctx        *mocks.MockContext
+		istioClient *istiofake.Clientset
+		recorder    *record.FakeRecorder
+		merge       *v1alpha1.VirtualServiceMerge
+	)
+
+	route := func(name, dest string) *networkingv1alpha3.HTTPRoute {
+		return &networkingv1alpha3.HTTPRoute{
+			Name:  name,
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: dest}}},
+		}
+	}
+	routeNames := func(routes []*networkingv1alpha3.HTTPRoute) []string {
+		names := make([]string, len(routes))
+		for i, r := range routes {
+			names[i] = r.Name
+		}
+		return names
+	}
+	getTarget := func() *istio.VirtualService {
+		target, err := istioClient.NetworkingV1alpha3().VirtualServices("default").Get(context.TODO(), "reviews", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return target
+	}
+	// reconcile reconciles the stored merge
+	reconcile := func() {
+		Expect(rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), merge)).To(Succeed())
+		Expect(Reconcile(rctx, istioClient, recorder, merge, nil, opts)).To(Succeed())
+	}
+	// writes returns the writes of the target since the last call
+	writes := func() int {
+		count := 0
+		for _, action := range istioClient.Actions() {
+			if action.GetResource().Resource == "virtualservices" && (action.GetVerb() == "update" || action.GetVerb() == "patch") {
+				count++
+			}
+		}
+		istioClient.ClearActions()
+		return count
+	}
+
+	BeforeEach(func() {
+		merge = &v1alpha1.VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "m", UID: "m-uid", Generation: 1, Finalizers: []string{finalizerName},
+		}}
+		merge.Spec.Target.Name = "reviews"
+		merge.Spec.Patch.Http = []*networkingv1alpha3.HTTPRoute{route("reviews-v2-1", "reviews-v2")}
+		target := &istio.VirtualService{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "reviews"}}
+		target.Spec.Http = []*networkingv1alpha3.HTTPRoute{route("default", "reviews")}
+		rctx = newTestContext(merge)
+		istioClient = istiofake.NewSimpleClientset(target)
+		recorder = record.NewFakeRecorder(100)
+	})
+
+	It("stores the base spec of the target on the first render", func() {
+		reconcile()
+		target := getTarget()
+		Expect(routeNames(target.Spec.Http)).To(Equal([]string{"reviews-v2-1", "default"}))
+		base, err := v1alpha1.ReadBase(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routeNames(base.Http)).To(Equal([]string{"default"}))
+		Expect(target.Annotations).To(HaveKeyWithValue(v1alpha1.RenderedAnnotation, v1alpha1.SpecHash(&target.Spec)))
+	})
+
+	It("rebases on the target edited since it was rendered", func() {
+		reconcile()
+		edited := getTarget()
+		edited.Spec.Http = append(edited.Spec.Http, route("manual", "reviews-v1"))
+		_, err := istioClient.NetworkingV1alpha3().VirtualServices("default").Update(context.TODO(), edited, metav1.UpdateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		reconcile()
+		target := getTarget()
+		Expect(routeNames(target.Spec.Http)).To(Equal([]string{"reviews-v2-1", "default", "manual"}))
+		base, err := v1alpha1.ReadBase(target)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routeNames(base.Http)).To(Equal([]string{"default", "manual"}))
+	})
+
+	It("skips the write when the target is rendered as it was last written", func() {
+		reconcile()
+		Expect(writes()).To(Equal(1))
+		rendered := getTarget()
+
+		reconcile()
+		Expect(writes()).To(BeZero())
+		Expect(getTarget()).To(Equal(rendered))
+	})
+})
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/operator-helper/reconciler"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// unresolvedError reports a target host resolved to no VirtualService or to several of them.
+// It is not retried, the merge is reconciled again when a VirtualService with the host changes.
+type unresolvedError struct {
+	reason  string
+	message string
+}
+
+func (e *unresolvedError) Error() string {
+	return e.message
+}
+
+func isUnresolved(err error) bool {
+	var unresolved *unresolvedError
+	return errors.As(err, &unresolved)
+}
+
+// resolveTarget returns the VirtualService the target of the merge designates,
+// by its name or by the single VirtualService serving its host
+func resolveTarget(ctx context.Context, rctx reconciler.Context, patch *v1alpha1.VirtualServiceMerge) (v1alpha1.TargetReference, error) {
+	if patch.Spec.Target.Host == "" {
+		return patch.Spec.Target.Reference(patch.Namespace), nil
+	}
+	candidates, err := hostCandidates(ctx, rctx, patch)
+	if err != nil {
+		return v1alpha1.TargetReference{}, err
+	}
+	target := patch.Spec.Target.String(patch.Namespace)
+	switch len(candidates) {
+	case 0:
+		return v1alpha1.TargetReference{}, &unresolvedError{
+			reason:  v1alpha1.ReasonTargetNotFound,
+			message: fmt.Sprintf("No %s found", target),
+		}
+	case 1:
+		return candidates[0], nil
+	}
+	names := make([]string, len(candidates))
+	for i, ref := range candidates {
+		names[i] = ref.String()
+	}
+	return v1alpha1.TargetReference{}, &unresolvedError{
+		reason:  v1alpha1.ReasonAmbiguousTarget,
+		message: fmt.Sprintf("Several candidates for the %s: %s", target, strings.Join(names, ", ")),
+	}
+}
+
+// hostCandidates returns the VirtualServices serving the host of the target
+func hostCandidates(ctx context.Context, rctx reconciler.Context, patch *v1alpha1.VirtualServiceMerge) ([]v1alpha1.TargetReference, error) {
+	list := &istio.VirtualServiceList{}
+	if err := rctx.Client().List(ctx, list, client.InNamespace(patch.Spec.Target.Namespace)); err != nil {
+		return nil, err
+	}
+	refs := make([]v1alpha1.TargetReference, 0)
+	for _, vs := range list.Items {
+		if vs.DeletionTimestamp.IsZero() && patch.Spec.Target.Matches(patch.Namespace, vs) {
+			refs = append(refs, v1alpha1.TargetReference{Name: vs.Name, Namespace: vs.Namespace})
+		}
+	}
+	sortTargets(refs)
+	return refs, nil
+}
+
+// recordUnresolved reflects a target host resolved to no or several VirtualServices onto the status of the merge
+func recordUnresolved(patch *v1alpha1.VirtualServiceMerge, err *unresolvedError) {
+	patch.Status.ObservedGeneration = patch.Generation
+	patch.Status.HandledRevision = patch.ResourceVersion
+	patch.Status.LastError = err.message
+	patch.SetCondition(v1alpha1.ConditionTargetFound, metav1.ConditionFalse, err.reason, err.message)
+	patch.SetCondition(v1alpha1.ConditionApplied, metav1.ConditionFalse, err.reason, "")
+	patch.SetCondition(v1alpha1.ConditionReady, metav1.ConditionFalse, err.reason, "")
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	"github.com/monimesl/operator-helper/reconciler"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// reconcileSelected applies the patch to every VirtualService selected by its target, and
+// removes it from the VirtualServices it was applied to which are not selected anymore.
+func reconcileSelected(ctx reconciler.Context, client versionedclient.Interface, recorder record.EventRecorder, patch *v1alpha1.VirtualServiceMerge, opts Options) error {
+	log := mergeLogger(ctx, patch)
+	refs, err := selectTargets(context.TODO(), ctx, patch)
+	if err != nil {
+		return err
+	}
+	selected := map[v1alpha1.TargetReference]bool{}
+	for _, ref := range refs {
+		selected[ref] = true
+	}
+	applied := appliedTargets(patch)
+	stale := make([]v1alpha1.TargetReference, 0)
+	for ref := range applied {
+		if !selected[ref] {
+			stale = append(stale, ref)
+		}
+	}
+	changed := len(stale) > 0
+	for _, ref := range refs {
+		changed = changed || !applied[ref]
+	}
+	if !changed && patch.Generation == patch.Status.ObservedGeneration && !resyncDue(patch, opts) {
+		for _, ref := range refs {
+			drifted, err := targetDrifted(ctx, recorder, patch, ref, opts)
+			if err != nil {
+				return err
+			}
+			changed = changed || drifted
+		}
+		if !changed {
+			return nil
+		}
+	}
+	previous := patch.Status.DeepCopy()
+	targets, err := removeTargets(ctx, client, recorder, patch, stale, opts)
+	errs := []error{err}
+	for _, ref := range refs {
+		err := updateTarget(ctx, client, recorder, patch, ref, false, opts)
+		switch {
+		case err == nil:
+			targets = append(targets, ref)
+		case kerr.IsNotFound(err):
+			// deleted since it was listed
+			log.Info("Selected VirtualService not found, nothing to sync", "action", actionApply, "virtualService", ref.String())
+		default:
+			errs = append(errs, fmt.Errorf("VirtualService %s: %w", ref, err))
+			if applied[ref] {
+				// the patch may still be in the target, it is removed once unselected
+				targets = append(targets, ref)
+			}
+		}
+	}
+	sortTargets(targets)
+	patch.Status.Targets = targets
+	patch.Status.Target = nil
+	err = errors.Join(errs...)
+	recordSelection(patch, err)
+	reportCondition(recorder, patch, nil, previous, v1alpha1.ConditionTargetFound, metav1.ConditionFalse, corev1.EventTypeWarning)
+	if err != nil {
+		recordEvent(recorder, patch, nil, corev1.EventTypeWarning, v1alpha1.ReasonUpdateFailed, err.Error())
+	}
+	if serr := ctx.Client().Status().Update(context.TODO(), patch); serr != nil {
+		return fmt.Errorf("VirtualServiceMerge object (%s) status update error: %w", patch.Name, serr)
+	}
+	return err
+}
+
+// appliedTargets returns the VirtualServices the patch was applied to, by its selector
+// or by the name its target had before being changed to a selector
+func appliedTargets(patch *v1alpha1.VirtualServiceMerge) map[v1alpha1.TargetReference]bool {
+	applied := map[v1alpha1.TargetReference]bool{}
+	for _, ref := range patch.Status.Targets {
+		applied[ref] = true
+	}
+	if patch.Status.Target != nil {
+		applied[*patch.Status.Target] = true
+	}
+	return applied
+}
+
+// removeTargets removes the patch from the VirtualServices, and returns the ones it could not be removed from
+func removeTargets(ctx reconciler.Context, client versionedclient.Interface, recorder record.EventRecorder, patch *v1alpha1.VirtualServiceMerge, refs []v1alpha1.TargetReference, opts Options) ([]v1alpha1.TargetReference, error) {
+	log := mergeLogger(ctx, patch).WithValues("action", actionRemove)
+	remaining := make([]v1alpha1.TargetReference, 0)
+	errs := make([]error, 0)
+	for _, ref := range refs {
+		log.Info("VirtualService not targeted anymore, removing the patch", "virtualService", ref.String())
+		if err := updateTarget(ctx, client, recorder, patch, ref, true, opts); err != nil {
+			if kerr.IsNotFound(err) {
+				log.Info("Target VirtualService not found, nothing to sync", "virtualService", ref.String())
+				continue
+			}
+			remaining = append(remaining, ref)
+			errs = append(errs, fmt.Errorf("VirtualService %s: %w", ref, err))
+		}
+	}
+	return remaining, errors.Join(errs...)
+}
+
+// selectTargets returns the VirtualServices selected by the target of the merge
+func selectTargets(ctx context.Context, rctx reconciler.Context, patch *v1alpha1.VirtualServiceMerge) ([]v1alpha1.TargetReference, error) {
+	selector, namespaceSelector, err := patch.Spec.Target.Selectors()
+	if err != nil {
+		return nil, fmt.Errorf("virtualservicepatch.Reconcile: %w", err)
+	}
+	namespaces := []string{patch.Spec.Target.Reference(patch.Namespace).Namespace}
+	if namespaceSelector != nil {
+		list := &corev1.NamespaceList{}
+		if err := rctx.Client().List(ctx, list, client.MatchingLabelsSelector{Selector: namespaceSelector}); err != nil {
+			return nil, err
+		}
+		namespaces = namespaces[:0]
+		for i := range list.Items {
+			namespaces = append(namespaces, list.Items[i].Name)
+		}
+	}
+	refs := make([]v1alpha1.TargetReference, 0)
+	for _, namespace := range namespaces {
+		list := &istio.VirtualServiceList{}
+		if err := rctx.Client().List(ctx, list, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, err
+		}
+		for _, vs := range list.Items {
+			if vs.DeletionTimestamp.IsZero() {
+				refs = append(refs, v1alpha1.TargetReference{Name: vs.Name, Namespace: vs.Namespace})
+			}
+		}
+	}
+	sortTargets(refs)
+	return refs, nil
+}
+
+// namespaceSelecting returns the requests of the merges selecting the namespaces of their targets, which
+// are reconciled on namespace changes as the VirtualServices of a namespace may be selected or not anymore
+func namespaceSelecting(ctx context.Context, rctx reconciler.Context) ([]reconcile.Request, error) {
+	merges, err := listIndexed(ctx, rctx, selectorIndexValue)
+	if err != nil {
+		return nil, err
+	}
+	requests := make([]reconcile.Request, 0)
+	for i := range merges.Items {
+		if merge := &merges.Items[i]; merge.Spec.Target.NamespaceSelector != nil {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: merge.Namespace, Name: merge.Name},
+			})
+		}
+	}
+	return requests, nil
+}
+
+func sortTargets(refs []v1alpha1.TargetReference) {
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].String() < refs[j].String()
+	})
+}
+
+// recordSelection reflects the outcome of applying the patch to the selected VirtualServices onto its status
+func recordSelection(patch *v1alpha1.VirtualServiceMerge, err error) {
+	switch {
+	case err == nil && len(patch.Status.Targets) == 0:
+		patch.Status.ObservedGeneration = patch.Generation
+		patch.Status.HandledRevision = patch.ResourceVersion
+		patch.Status.LastAppliedTime = metav1.Now()
+		patch.Status.LastError = ""
+		patch.Status.HttpRoutes, patch.Status.TcpRoutes, patch.Status.TlsRoutes = nil, nil, nil
+		patch.SetCondition(v1alpha1.ConditionTargetFound, metav1.ConditionFalse, v1alpha1.ReasonNoTargetMatched,
+			fmt.Sprintf("No VirtualService matches the target selector %s", metav1.FormatLabelSelector(patch.Spec.Target.Selector)))
+		patch.SetCondition(v1alpha1.ConditionApplied, metav1.ConditionFalse, v1alpha1.ReasonNoTargetMatched, "")
+		patch.SetCondition(v1alpha1.ConditionReady, metav1.ConditionFalse, v1alpha1.ReasonNoTargetMatched, "")
+	case err == nil:
+		patch.Status.ObservedGeneration = patch.Generation
+		patch.Status.HandledRevision = patch.ResourceVersion
+		patch.Status.LastAppliedTime = metav1.Now()
+		patch.Status.LastError = ""
+		patch.Status.DryRun = nil
+		patch.SetCondition(v1alpha1.ConditionTargetFound, metav1.ConditionTrue, v1alpha1.ReasonTargetFound,
+			fmt.Sprintf("%d VirtualServices match the target selector", len(patch.Status.Targets)))
+		patch.SetCondition(v1alpha1.ConditionApplied, metav1.ConditionTrue, v1alpha1.ReasonApplied,
+			fmt.Sprintf("Patch applied to %d VirtualServices", len(patch.Status.Targets)))
+		setReady(patch)
+	default:
+		recordStatus(patch, err)
+	}
+}
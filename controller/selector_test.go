@@ -0,0 +1,103 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	networkingv1alpha3 "istio.io/api/networking/v1alpha3"
+	istio "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	istiofake "istio.io/client-go/pkg/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Namespace selector", func() {
+	route := func(name, dest string) *networkingv1alpha3.HTTPRoute {
+		return &networkingv1alpha3.HTTPRoute{
+			Name:  name,
+			Route: []*networkingv1alpha3.HTTPRouteDestination{{Destination: &networkingv1alpha3.Destination{Host: dest}}},
+		}
+	}
+	newNamespace := func(name string, labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	newVirtualService := func(namespace string) *istio.VirtualService {
+		vs := &istio.VirtualService{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace, Name: "reviews", Labels: map[string]string{"app": "reviews"},
+		}}
+		vs.Spec.Http = []*networkingv1alpha3.HTTPRoute{route("default", "reviews")}
+		return vs
+	}
+	newMerge := func(name string, namespaceSelector *metav1.LabelSelector) *v1alpha1.VirtualServiceMerge {
+		merge := &v1alpha1.VirtualServiceMerge{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: name, UID: types.UID(name + "-uid"), Finalizers: []string{finalizerName},
+		}}
+		merge.Spec.Target.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "reviews"}}
+		merge.Spec.Target.NamespaceSelector = namespaceSelector
+		merge.Spec.Patch.Http = []*networkingv1alpha3.HTTPRoute{route("healthz-1", "healthz")}
+		return merge
+	}
+	teamA := &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}
+
+	It("maps a namespace change to the merges selecting namespaces", func() {
+		rctx := newTestContext(newMerge("namespaces", teamA), newMerge("labels", nil))
+
+		requests, err := namespaceSelecting(context.TODO(), rctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(Equal([]reconcile.Request{
+			{NamespacedName: types.NamespacedName{Namespace: "default", Name: "namespaces"}},
+		}))
+	})
+
+	It("removes the patch from the VirtualServices of a namespace not selected anymore", func() {
+		merge := newMerge("m", teamA)
+		merge.Generation, merge.Status.ObservedGeneration = 1, 1
+		merge.Status.LastAppliedTime = metav1.Now()
+		// the namespace b was selected when the patch was applied, its label was removed since
+		merge.Status.Targets = []v1alpha1.TargetReference{{Namespace: "b", Name: "reviews"}}
+		applied := newVirtualService("b")
+		ledger := v1alpha1.OwnershipLedger{}
+		Expect(merge.AddHttpRoutes(logr.Discard(), applied, ledger)).To(BeEmpty())
+		Expect(ledger.Write(applied)).To(Succeed())
+		selected := newVirtualService("a")
+		rctx := newTestContext(merge, newNamespace("a", teamA.MatchLabels), newNamespace("b", nil), applied, selected)
+		istioClient := istiofake.NewSimpleClientset(applied, selected)
+		Expect(rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), merge)).To(Succeed())
+
+		Expect(Reconcile(rctx, istioClient, record.NewFakeRecorder(100), merge, nil, Options{})).To(Succeed())
+		for namespace, want := range map[string][]string{"a": {"healthz-1", "default"}, "b": {"default"}} {
+			vs, err := istioClient.NetworkingV1alpha3().VirtualServices(namespace).Get(context.TODO(), "reviews", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			names := make([]string, 0)
+			for _, r := range vs.Spec.Http {
+				names = append(names, r.Name)
+			}
+			Expect(names).To(Equal(want), "the routes of %s/reviews", namespace)
+		}
+		Expect(rctx.Client().Get(context.TODO(), client.ObjectKeyFromObject(merge), merge)).To(Succeed())
+		Expect(merge.Status.Targets).To(Equal([]v1alpha1.TargetReference{{Namespace: "a", Name: "reviews"}}))
+	})
+})
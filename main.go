@@ -19,15 +19,16 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 
 	"github.com/monimesl/istio-virtualservice-merger/api/v1alpha1"
 	"github.com/monimesl/istio-virtualservice-merger/controller"
-	"go.uber.org/zap/zapcore"
 	"istio.io/client-go/pkg/apis/networking/v1alpha3"
 	versionedclient "istio.io/client-go/pkg/clientset/versioned"
 
 	"github.com/monimesl/operator-helper/config"
 	"github.com/monimesl/operator-helper/reconciler"
+	"github.com/monimesl/operator-helper/webhook"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -53,16 +54,24 @@ func init() {
 
 func main() {
 	var namespace string
+	var maxConcurrentReconciles int
+	var enableWebhook bool
+	var mergeOpts controllers.Options
 	flag.StringVar(&namespace, "namespace", "istio-virtualservice-merger", "Select which namespace this controller is deployed")
+	flag.BoolVar(&mergeOpts.FullRender, "full-render", false, "Re-render every target from its base spec and all of its merges on each reconcile")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1, "Number of merges reconciled in parallel, merges of the same target are always serialized")
+	flag.BoolVar(&mergeOpts.ServerSideApply, "server-side-apply", false, "Write the targets with server-side apply instead of updates")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false, "Serve the validating admission webhook of the VirtualServiceMerge")
+	flag.DurationVar(&mergeOpts.ResyncPeriod, "resync-period", 10*time.Minute, "Period after which every merge is re-applied to its target, 0 to disable")
+	flag.DurationVar(&mergeOpts.DriftCheckPeriod, "drift-check-period", time.Hour, "Period after which every target is re-rendered from its merges and fixed when drifted, 0 to disable")
+	flag.BoolVar(&mergeOpts.DriftReportOnly, "drift-report-only", false, "Report the targets drifted from their merges without fixing them")
+	// set logger, --zap-log-level=debug logs the merged routes and --zap-devel the development format
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	// set logger
-	opts := zap.Options{
-		Development: true,
-		Encoder:     zapcore.NewJSONEncoder(zapcore.EncoderConfig{}),
-	}
-
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	// the manager logs with the logger of the operator, created once
+	config.GetLogger(namespace, zap.UseFlagOptions(&opts))
 
 	// start manager
 	cfg, options := config.GetManagerParams(scheme,
@@ -78,10 +87,26 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create istio client: %s", err)
 	}
-	if err = reconciler.Configure(mgr,
-		&controllers.VirtualServicePatchReconciler{IstioClient: ic, OldObjectCache: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})}); err != nil {
+	mergeReconciler := &controllers.VirtualServicePatchReconciler{
+		IstioClient:             ic,
+		OldObjectCache:          cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		FieldIndexer:            mgr.GetFieldIndexer(),
+		Recorder:                mgr.GetEventRecorderFor("istio-virtualservice-merger"),
+		Options:                 mergeOpts,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+	}
+	if err = reconciler.Configure(mgr, mergeReconciler); err != nil {
 		log.Fatalf("reconciler cfg error: %s", err)
 	}
+	// the drift check runs on the leader only, like the reconciles
+	if err = mgr.Add(manager.RunnableFunc(mergeReconciler.CheckDrift)); err != nil {
+		log.Fatalf("drift check cfg error: %s", err)
+	}
+	if enableWebhook {
+		if err = webhook.Configure(mgr, &v1alpha1.VirtualServiceMerge{}); err != nil {
+			log.Fatalf("webhook cfg error: %s", err)
+		}
+	}
 	if err = mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		log.Fatalf("operator start error: %s", err)
 	}